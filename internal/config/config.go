@@ -0,0 +1,201 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gh-actions-exporter/internal/metrics"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the exporter configuration
+type Config struct {
+	Metrics metrics.Config `yaml:"metrics"`
+
+	// ExternalMetricsAPI serves the job counts as a Kubernetes external metrics API
+	ExternalMetricsAPI bool `yaml:"external_metrics_api"`
+}
+
+// Load builds the configuration from the defaults, the optional YAML file referenced by
+// CONFIG_FILE and the environment, in that order of precedence
+func Load() (*Config, error) {
+	cfg := &Config{
+		Metrics: metrics.DefaultConfig(),
+	}
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	if value := os.Getenv("WORKFLOW_DURATION_BUCKETS"); value != "" {
+		buckets, err := parseFloatList(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WORKFLOW_DURATION_BUCKETS: %w", err)
+		}
+		cfg.Metrics.DurationBuckets = buckets
+	}
+
+	if value := os.Getenv("WORKFLOW_QUEUE_BUCKETS"); value != "" {
+		buckets, err := parseFloatList(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid WORKFLOW_QUEUE_BUCKETS: %w", err)
+		}
+		cfg.Metrics.QueueBuckets = buckets
+	}
+
+	if value := os.Getenv("SERIES_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SERIES_TTL: %w", err)
+		}
+		cfg.Metrics.SeriesTTL = ttl
+	}
+
+	if value := os.Getenv("SERIES_TTL_BY_BRANCH_CLASS"); value != "" {
+		ttls, err := parseBranchClassDurations(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SERIES_TTL_BY_BRANCH_CLASS: %w", err)
+		}
+		cfg.Metrics.SeriesTTLByBranchClass = ttls
+	}
+
+	if value := os.Getenv("MAX_SERIES"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid MAX_SERIES: %q", value)
+		}
+		cfg.Metrics.MaxSeries = limit
+	}
+
+	if value := os.Getenv("MAX_SERIES_PER_REPOSITORY"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid MAX_SERIES_PER_REPOSITORY: %q", value)
+		}
+		cfg.Metrics.MaxSeriesPerRepository = limit
+	}
+
+	if value := os.Getenv("RUN_INFO_LIMIT"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid RUN_INFO_LIMIT: %q", value)
+		}
+		cfg.Metrics.RunInfoLimit = limit
+	}
+
+	if value := os.Getenv("RUN_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RUN_TIMEOUT: %w", err)
+		}
+		cfg.Metrics.RunTimeout = timeout
+	}
+
+	if value := os.Getenv("RUNNER_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RUNNER_TTL: %w", err)
+		}
+		cfg.Metrics.RunnerTTL = ttl
+	}
+
+	if value := os.Getenv("MAX_STEPS_PER_JOB"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid MAX_STEPS_PER_JOB: %q", value)
+		}
+		cfg.Metrics.MaxStepsPerJob = limit
+	}
+
+	if value := os.Getenv("MAX_MATRIX_COMBINATIONS_PER_JOB"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid MAX_MATRIX_COMBINATIONS_PER_JOB: %q", value)
+		}
+		cfg.Metrics.Matrix.MaxCombinationsPerJob = limit
+	}
+
+	if value := os.Getenv("EXTERNAL_METRICS_API"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EXTERNAL_METRICS_API: %q", value)
+		}
+		cfg.ExternalMetricsAPI = enabled
+	}
+
+	if value := os.Getenv("WORKFLOW_LABEL"); value != "" {
+		cfg.Metrics.WorkflowLabel = value
+	}
+
+	if err := cfg.Metrics.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid metrics configuration: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// parseFloatList parses a comma-separated list of increasing numbers, e.g. "30,60,300"
+func parseFloatList(value string) ([]float64, error) {
+	var result []float64
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, err
+		}
+		if len(result) > 0 && f <= result[len(result)-1] {
+			return nil, fmt.Errorf("values must be in increasing order")
+		}
+		result = append(result, f)
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no values given")
+	}
+
+	return result, nil
+}
+
+// parseBranchClassDurations parses a comma-separated list of class=duration pairs, e.g. "default=0,feature=72h"
+func parseBranchClassDurations(value string) (map[metrics.BranchClass]time.Duration, error) {
+	result := make(map[metrics.BranchClass]time.Duration)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, rawDuration, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected class=duration, got %q", part)
+		}
+
+		class := metrics.BranchClass(strings.TrimSpace(name))
+		switch class {
+		case metrics.BranchClassDefault, metrics.BranchClassRelease, metrics.BranchClassTag, metrics.BranchClassFeature:
+		default:
+			return nil, fmt.Errorf("unknown branch class %q", class)
+		}
+
+		duration, err := time.ParseDuration(strings.TrimSpace(rawDuration))
+		if err != nil {
+			return nil, err
+		}
+		result[class] = duration
+	}
+
+	return result, nil
+}
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gh-actions-exporter/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad_Defaults(t *testing.T) {
+	cfg, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, metrics.DefaultConfig(), cfg.Metrics)
+}
+
+func TestLoad_DurationBuckets(t *testing.T) {
+	t.Setenv("WORKFLOW_DURATION_BUCKETS", "30, 60,300")
+
+	cfg, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, []float64{30, 60, 300}, cfg.Metrics.DurationBuckets)
+}
+
+func TestLoad_InvalidDurationBuckets(t *testing.T) {
+	t.Setenv("WORKFLOW_DURATION_BUCKETS", "60,30")
+
+	_, err := Load()
+	assert.Error(t, err)
+
+	t.Setenv("WORKFLOW_DURATION_BUCKETS", "abc")
+
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_SeriesTTL(t *testing.T) {
+	t.Setenv("SERIES_TTL", "72h")
+	t.Setenv("SERIES_TTL_BY_BRANCH_CLASS", "default=0, release=720h")
+
+	cfg, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, 72*time.Hour, cfg.Metrics.SeriesTTL)
+	assert.Equal(t, map[metrics.BranchClass]time.Duration{
+		metrics.BranchClassDefault: 0,
+		metrics.BranchClassRelease: 720 * time.Hour,
+	}, cfg.Metrics.SeriesTTLByBranchClass)
+}
+
+func TestLoad_InvalidSeriesTTL(t *testing.T) {
+	t.Setenv("SERIES_TTL_BY_BRANCH_CLASS", "unknown=1h")
+
+	_, err := Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_RunnerTTL(t *testing.T) {
+	cfg, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, cfg.Metrics.RunnerTTL)
+
+	t.Setenv("RUNNER_TTL", "6h")
+	cfg, err = Load()
+	require.NoError(t, err)
+	assert.Equal(t, 6*time.Hour, cfg.Metrics.RunnerTTL)
+
+	t.Setenv("RUNNER_TTL", "soon")
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_SeriesLimits(t *testing.T) {
+	t.Setenv("MAX_SERIES", "10000")
+	t.Setenv("MAX_SERIES_PER_REPOSITORY", "500")
+
+	cfg, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, 10000, cfg.Metrics.MaxSeries)
+	assert.Equal(t, 500, cfg.Metrics.MaxSeriesPerRepository)
+
+	t.Setenv("MAX_SERIES", "-1")
+
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_ConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+metrics:
+  series_ttl: 72h
+  max_series_per_repository: 200
+  relabel_configs:
+    - source_labels: [branch]
+      regex: "(feature|renovate)/.*"
+      target_label: branch
+      replacement: feature
+`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("MAX_SERIES_PER_REPOSITORY", "100")
+
+	cfg, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, 72*time.Hour, cfg.Metrics.SeriesTTL)
+	// Environment variables take precedence over the file
+	assert.Equal(t, 100, cfg.Metrics.MaxSeriesPerRepository)
+	// Defaults are kept for settings missing in the file
+	assert.Equal(t, metrics.DefaultConfig().DurationBuckets, cfg.Metrics.DurationBuckets)
+	replacement := "feature"
+	assert.Equal(t, []metrics.RelabelConfig{{
+		SourceLabels: []string{"branch"},
+		Regex:        "(feature|renovate)/.*",
+		TargetLabel:  "branch",
+		Replacement:  &replacement,
+	}}, cfg.Metrics.RelabelConfigs)
+}
+
+func TestLoad_InvalidConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+metrics:
+  relabel_configs:
+    - source_labels: [branch]
+      regex: "("
+      target_label: branch
+`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	t.Setenv("CONFIG_FILE", path)
+
+	_, err := Load()
+	assert.Error(t, err)
+
+	// Buckets and branch classes are checked like their environment variables
+	for content, message := range map[string]string{
+		"metrics:\n  duration_buckets: [600, 60]\n":                  "duration buckets must be in increasing order",
+		"metrics:\n  queue_buckets: []\n":                            "no queue buckets given",
+		"metrics:\n  series_ttl_by_branch_class:\n    develop: 1h\n": "unknown branch class",
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err = Load()
+		assert.ErrorContains(t, err, message, content)
+	}
+
+	t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_WorkflowLabel(t *testing.T) {
+	t.Setenv("WORKFLOW_LABEL", "path")
+
+	cfg, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, metrics.WorkflowLabelPath, cfg.Metrics.WorkflowLabel)
+
+	t.Setenv("WORKFLOW_LABEL", "filename")
+
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_MaxStepsPerJob(t *testing.T) {
+	t.Setenv("MAX_STEPS_PER_JOB", "0")
+
+	cfg, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, 0, cfg.Metrics.MaxStepsPerJob)
+
+	t.Setenv("MAX_STEPS_PER_JOB", "many")
+
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_BillingConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `
+metrics:
+  billing:
+    os_multipliers:
+      macos: 12
+    sku_prices:
+      ubuntu-latest-16-cores: 0.064
+    self_hosted_price_per_hour:
+      gpu-pool: 2.5
+      "*": 0.1
+`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	t.Setenv("CONFIG_FILE", path)
+
+	cfg, err := Load()
+	require.NoError(t, err)
+	// Prices missing in the file keep their defaults
+	assert.Equal(t, 0.008, cfg.Metrics.Billing.PricePerMinute)
+	assert.Equal(t, map[string]float64{"linux": 1, "windows": 2, "macos": 12}, cfg.Metrics.Billing.OSMultipliers)
+	assert.Equal(t, map[string]float64{"ubuntu-latest-16-cores": 0.064}, cfg.Metrics.Billing.SKUPrices)
+	assert.Equal(t, map[string]float64{"gpu-pool": 2.5, metrics.DefaultRunnerGroupPrice: 0.1}, cfg.Metrics.Billing.SelfHostedPricePerHour)
+
+	content = `
+metrics:
+  billing:
+    price_per_minute: -1
+`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_MaxMatrixCombinationsPerJob(t *testing.T) {
+	t.Setenv("MAX_MATRIX_COMBINATIONS_PER_JOB", "50")
+
+	cfg, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, 50, cfg.Metrics.Matrix.MaxCombinationsPerJob)
+
+	t.Setenv("MAX_MATRIX_COMBINATIONS_PER_JOB", "-5")
+
+	_, err = Load()
+	assert.Error(t, err)
+}
+
+func TestLoad_ExternalMetricsAPI(t *testing.T) {
+	cfg, err := Load()
+	require.NoError(t, err)
+	assert.False(t, cfg.ExternalMetricsAPI)
+
+	t.Setenv("EXTERNAL_METRICS_API", "true")
+
+	cfg, err = Load()
+	require.NoError(t, err)
+	assert.True(t, cfg.ExternalMetricsAPI)
+
+	t.Setenv("EXTERNAL_METRICS_API", "sometimes")
+
+	_, err = Load()
+	assert.Error(t, err)
+}
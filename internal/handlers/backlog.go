@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"gh-actions-exporter/internal/metrics"
+)
+
+// BacklogHandler returns the queued jobs that a runner with the requested labels could pick up.
+// Labels are given as a comma separated list, e.g. ?labels=self-hosted,linux, or as repeated
+// labels parameters; without labels the whole backlog is returned.
+func BacklogHandler(c *gin.Context, processor *metrics.MetricsProcessor) {
+	var labels []string
+	for _, param := range c.QueryArray("labels") {
+		labels = append(labels, strings.Split(param, ",")...)
+	}
+
+	c.JSON(200, processor.Backlog(labels))
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gh-actions-exporter/internal/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBacklogHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	logger := zap.NewNop()
+	registry := prometheus.NewRegistry()
+	processor := metrics.NewMetricsProcessor(logger, registry)
+	router.GET("/api/v1/backlog", func(c *gin.Context) {
+		BacklogHandler(c, processor)
+	})
+
+	for id, labels := range map[int64][]string{
+		1: {"self-hosted", "linux", "gpu"},
+		2: {"self-hosted", "linux"},
+	} {
+		require.NoError(t, processor.ProcessWorkflowJob(context.Background(), metrics.WorkflowJob{
+			ID:           id,
+			RunID:        100,
+			Name:         "build",
+			WorkflowName: "CI",
+			Repository:   "myorg/myrepo",
+			Status:       metrics.WorkflowRunStatusQueued,
+			Labels:       labels,
+		}))
+	}
+
+	for _, tt := range []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    "",
+			expected: `{"queued":2,"in_progress":0,"label_sets":[{"labels":"gpu,linux,self-hosted","queued":1,"in_progress":0},{"labels":"linux,self-hosted","queued":1,"in_progress":0}]}`,
+		},
+		{
+			query:    "?labels=self-hosted,linux",
+			expected: `{"labels":["linux","self-hosted"],"queued":1,"in_progress":0,"label_sets":[{"labels":"linux,self-hosted","queued":1,"in_progress":0}]}`,
+		},
+		{
+			query:    "?labels=windows",
+			expected: `{"labels":["windows"],"queued":0,"in_progress":0,"label_sets":[]}`,
+		},
+	} {
+		req, _ := http.NewRequest("GET", "/api/v1/backlog"+tt.query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.JSONEq(t, tt.expected, w.Body.String(), tt.query)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 	"io"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,9 +21,14 @@ type GitHubWorkflowRunEvent struct {
 	Action      string `json:"action"`
 	WorkflowRun struct {
 		ID         int64  `json:"id"`
+		RunNumber  int    `json:"run_number"`
 		Name       string `json:"name"`
+		WorkflowID int64  `json:"workflow_id"`
+		Path       string `json:"path"` // Path of the workflow file
 		Status     string `json:"status"`
 		Conclusion string `json:"conclusion"`
+		RunAttempt int    `json:"run_attempt"`
+		CreatedAt  string `json:"created_at"`
 		StartedAt  string `json:"run_started_at"`
 		UpdatedAt  string `json:"updated_at"`
 		HeadBranch string `json:"head_branch"` // Branch name
@@ -30,12 +37,106 @@ type GitHubWorkflowRunEvent struct {
 			ID string `json:"id"`
 		} `json:"head_commit"`
 		HeadSHA string `json:"head_sha"` // The SHA of the head commit
+		HTMLURL string `json:"html_url"` // Link to the run on GitHub
+		Actor   struct {
+			Login string `json:"login"`
+		} `json:"actor"`
+		PullRequests []struct {
+			Number int `json:"number"`
+			Head   struct {
+				Ref string `json:"ref"`
+			} `json:"head"`
+			Base struct {
+				Ref string `json:"ref"`
+			} `json:"base"`
+		} `json:"pull_requests"` // Pull requests the run belongs to, empty for pull requests from forks
+		HeadRepository struct {
+			FullName string `json:"full_name"`
+		} `json:"head_repository"` // Repository the head commit comes from, a fork for external pull requests
 	} `json:"workflow_run"`
 	Repository struct {
+		FullName      string `json:"full_name"`
+		DefaultBranch string `json:"default_branch"`
+	} `json:"repository"`
+}
+
+// GitHubWorkflowJobEvent represents the workflow_job event payload structure
+type GitHubWorkflowJobEvent struct {
+	Action      string `json:"action"`
+	WorkflowJob struct {
+		ID              int64    `json:"id"`
+		RunID           int64    `json:"run_id"`
+		RunAttempt      int      `json:"run_attempt"`
+		Name            string   `json:"name"`
+		WorkflowName    string   `json:"workflow_name"`
+		HeadBranch      string   `json:"head_branch"`
+		HeadSHA         string   `json:"head_sha"`
+		Status          string   `json:"status"`
+		Conclusion      string   `json:"conclusion"`
+		CreatedAt       string   `json:"created_at"`
+		StartedAt       string   `json:"started_at"`
+		CompletedAt     string   `json:"completed_at"`
+		Labels          []string `json:"labels"` // Runner labels requested by the job
+		RunnerID        int64    `json:"runner_id"`
+		RunnerName      string   `json:"runner_name"`
+		RunnerGroupName string   `json:"runner_group_name"`
+		HTMLURL         string   `json:"html_url"` // Link to the job on GitHub
+		Steps           []struct {
+			Name        string `json:"name"`
+			Number      int    `json:"number"`
+			Status      string `json:"status"`
+			Conclusion  string `json:"conclusion"`
+			StartedAt   string `json:"started_at"`
+			CompletedAt string `json:"completed_at"`
+		} `json:"steps"`
+	} `json:"workflow_job"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// GitHubDeploymentReviewJob represents a job waiting for a deployment review
+type GitHubDeploymentReviewJob struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Environment string `json:"environment"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+// GitHubDeploymentReviewEvent represents the deployment_review event payload structure
+type GitHubDeploymentReviewEvent struct {
+	Action      string `json:"action"`
+	Environment string `json:"environment"`
+	Since       string `json:"since"` // Time the review was requested
+	WorkflowRun struct {
+		ID         int64  `json:"id"`
+		Name       string `json:"name"`
+		RunAttempt int    `json:"run_attempt"`
+		HeadBranch string `json:"head_branch"`
+		HeadSHA    string `json:"head_sha"`
+	} `json:"workflow_run"`
+	WorkflowJobRun  *GitHubDeploymentReviewJob  `json:"workflow_job_run"`  // Job waiting for review, for requested reviews
+	WorkflowJobRuns []GitHubDeploymentReviewJob `json:"workflow_job_runs"` // Jobs reviewed, for approved and rejected reviews
+	Repository      struct {
 		FullName string `json:"full_name"`
 	} `json:"repository"`
 }
 
+// GitHubDeploymentProtectionRuleEvent represents the deployment_protection_rule event payload structure
+type GitHubDeploymentProtectionRuleEvent struct {
+	Action                string `json:"action"`
+	Environment           string `json:"environment"`
+	DeploymentCallbackURL string `json:"deployment_callback_url"` // Contains the ID of the waiting run
+	Repository            struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// callbackRunIDRegex extracts the run ID from a deployment callback URL, e.g.
+// https://api.github.com/repos/octo/repo/actions/runs/1234/deployment_protection_rule
+var callbackRunIDRegex = regexp.MustCompile(`/actions/runs/(\d+)/`)
+
 // verifyGitHubSignature verifies the GitHub webhook signature
 func verifyGitHubSignature(payload []byte, signature string, secret string) bool {
 	if secret == "" {
@@ -88,6 +189,12 @@ func WebhookHandler(c *gin.Context, processor *metrics.MetricsProcessor, logger
 	switch eventType {
 	case "workflow_run":
 		processWorkflowRunEvent(c, body, processor, logger)
+	case "workflow_job":
+		processWorkflowJobEvent(c, body, processor, logger)
+	case "deployment_review":
+		processDeploymentReviewEvent(c, body, processor, logger)
+	case "deployment_protection_rule":
+		processDeploymentProtectionRuleEvent(c, body, processor, logger)
 	default:
 		logger.Debug("Ignoring unsupported event type", zap.String("event", eventType))
 		c.JSON(200, gin.H{"status": "ignored", "event": eventType})
@@ -107,6 +214,7 @@ func processWorkflowRunEvent(c *gin.Context, body []byte, processor *metrics.Met
 	}
 
 	// Parse time fields
+	createdAt, _ := time.Parse(time.RFC3339, event.WorkflowRun.CreatedAt)
 	startedAt, _ := time.Parse(time.RFC3339, event.WorkflowRun.StartedAt)
 	updatedAt, _ := time.Parse(time.RFC3339, event.WorkflowRun.UpdatedAt)
 
@@ -140,18 +248,40 @@ func processWorkflowRunEvent(c *gin.Context, body []byte, processor *metrics.Met
 		refType = "tag"
 	}
 
+	headSHA := event.WorkflowRun.HeadSHA
+	if headSHA == "" {
+		headSHA = event.WorkflowRun.HeadCommit.ID
+	}
+
+	// Pull request runs carry the base branch of the first pull request
+	baseBranch := ""
+	if len(event.WorkflowRun.PullRequests) > 0 {
+		baseBranch = event.WorkflowRun.PullRequests[0].Base.Ref
+	}
+
 	// Create workflow run object
 	run := metrics.WorkflowRun{
-		ID:         event.WorkflowRun.ID,
-		Name:       event.WorkflowRun.Name,
-		Repository: event.Repository.FullName,
-		Status:     metrics.WorkflowRunStatus(event.WorkflowRun.Status),
-		Conclusion: metrics.WorkflowRunConclusion(event.WorkflowRun.Conclusion),
-		StartedAt:  startedAt,
-		UpdatedAt:  updatedAt,
-		Branch:     refName,
-		Trigger:    event.WorkflowRun.Event,
-		RefType:    refType,
+		ID:             event.WorkflowRun.ID,
+		RunNumber:      event.WorkflowRun.RunNumber,
+		Name:           event.WorkflowRun.Name,
+		WorkflowID:     event.WorkflowRun.WorkflowID,
+		WorkflowPath:   event.WorkflowRun.Path,
+		Repository:     event.Repository.FullName,
+		HeadRepository: event.WorkflowRun.HeadRepository.FullName,
+		Status:         metrics.WorkflowRunStatus(event.WorkflowRun.Status),
+		Conclusion:     metrics.WorkflowRunConclusion(event.WorkflowRun.Conclusion),
+		RunAttempt:     event.WorkflowRun.RunAttempt,
+		CreatedAt:      createdAt,
+		StartedAt:      startedAt,
+		UpdatedAt:      updatedAt,
+		Branch:         refName,
+		DefaultBranch:  event.Repository.DefaultBranch,
+		BaseBranch:     baseBranch,
+		Trigger:        event.WorkflowRun.Event,
+		RefType:        refType,
+		HeadSHA:        headSHA,
+		Actor:          event.WorkflowRun.Actor.Login,
+		HTMLURL:        event.WorkflowRun.HTMLURL,
 	}
 
 	// Process the workflow run
@@ -166,3 +296,161 @@ func processWorkflowRunEvent(c *gin.Context, body []byte, processor *metrics.Met
 			zap.String("status", string(run.Status)))
 	}
 }
+
+// processWorkflowJobEvent handles workflow_job events
+func processWorkflowJobEvent(c *gin.Context, body []byte, processor *metrics.MetricsProcessor, logger *zap.Logger) {
+	var event GitHubWorkflowJobEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		logger.Error("Failed to parse workflow_job event", zap.Error(err))
+		c.JSON(400, gin.H{"error": "Failed to parse workflow_job event"})
+		return
+	}
+
+	// Parse time fields
+	createdAt, _ := time.Parse(time.RFC3339, event.WorkflowJob.CreatedAt)
+	startedAt, _ := time.Parse(time.RFC3339, event.WorkflowJob.StartedAt)
+	completedAt, _ := time.Parse(time.RFC3339, event.WorkflowJob.CompletedAt)
+
+	steps := make([]metrics.WorkflowStep, 0, len(event.WorkflowJob.Steps))
+	for _, step := range event.WorkflowJob.Steps {
+		stepStartedAt, _ := time.Parse(time.RFC3339, step.StartedAt)
+		stepCompletedAt, _ := time.Parse(time.RFC3339, step.CompletedAt)
+		steps = append(steps, metrics.WorkflowStep{
+			Name:        step.Name,
+			Number:      step.Number,
+			Status:      metrics.WorkflowRunStatus(step.Status),
+			Conclusion:  metrics.WorkflowRunConclusion(step.Conclusion),
+			StartedAt:   stepStartedAt,
+			CompletedAt: stepCompletedAt,
+		})
+	}
+
+	// Create workflow job object
+	job := metrics.WorkflowJob{
+		ID:              event.WorkflowJob.ID,
+		RunID:           event.WorkflowJob.RunID,
+		RunAttempt:      event.WorkflowJob.RunAttempt,
+		Name:            event.WorkflowJob.Name,
+		WorkflowName:    event.WorkflowJob.WorkflowName,
+		Repository:      event.Repository.FullName,
+		Branch:          event.WorkflowJob.HeadBranch,
+		Status:          metrics.WorkflowRunStatus(event.WorkflowJob.Status),
+		Conclusion:      metrics.WorkflowRunConclusion(event.WorkflowJob.Conclusion),
+		CreatedAt:       createdAt,
+		StartedAt:       startedAt,
+		CompletedAt:     completedAt,
+		Labels:          event.WorkflowJob.Labels,
+		RunnerID:        event.WorkflowJob.RunnerID,
+		RunnerName:      event.WorkflowJob.RunnerName,
+		RunnerGroupName: event.WorkflowJob.RunnerGroupName,
+		HeadSHA:         event.WorkflowJob.HeadSHA,
+		HTMLURL:         event.WorkflowJob.HTMLURL,
+		Steps:           steps,
+	}
+
+	// Process the workflow job
+	if err := processor.ProcessWorkflowJob(c.Request.Context(), job); err != nil {
+		logger.Error("Failed to process workflow job",
+			zap.Error(err),
+			zap.Int64("jobID", job.ID),
+			zap.String("repository", job.Repository))
+	} else {
+		logger.Debug("Successfully processed workflow job",
+			zap.Int64("jobID", job.ID),
+			zap.String("status", string(job.Status)))
+	}
+}
+
+// processDeploymentReviewEvent handles deployment_review events
+func processDeploymentReviewEvent(c *gin.Context, body []byte, processor *metrics.MetricsProcessor, logger *zap.Logger) {
+	var event GitHubDeploymentReviewEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		logger.Error("Failed to parse deployment_review event", zap.Error(err))
+		c.JSON(400, gin.H{"error": "Failed to parse deployment_review event"})
+		return
+	}
+
+	since, _ := time.Parse(time.RFC3339, event.Since)
+
+	// Requested reviews carry a single job, approved and rejected reviews a list
+	jobRuns := event.WorkflowJobRuns
+	if event.WorkflowJobRun != nil {
+		jobRuns = append(jobRuns, *event.WorkflowJobRun)
+	}
+	jobs := make([]metrics.DeploymentReviewJob, 0, len(jobRuns))
+	for _, job := range jobRuns {
+		createdAt, _ := time.Parse(time.RFC3339, job.CreatedAt)
+		updatedAt, _ := time.Parse(time.RFC3339, job.UpdatedAt)
+		jobs = append(jobs, metrics.DeploymentReviewJob{
+			ID:          job.ID,
+			Name:        job.Name,
+			Environment: job.Environment,
+			CreatedAt:   createdAt,
+			UpdatedAt:   updatedAt,
+		})
+	}
+
+	// Create deployment review object
+	review := metrics.DeploymentReview{
+		Action:       metrics.DeploymentReviewAction(event.Action),
+		Repository:   event.Repository.FullName,
+		Environment:  event.Environment,
+		RunID:        event.WorkflowRun.ID,
+		RunAttempt:   event.WorkflowRun.RunAttempt,
+		WorkflowName: event.WorkflowRun.Name,
+		Branch:       event.WorkflowRun.HeadBranch,
+		HeadSHA:      event.WorkflowRun.HeadSHA,
+		Since:        since,
+		Jobs:         jobs,
+	}
+
+	// Process the deployment review
+	if err := processor.ProcessDeploymentReview(c.Request.Context(), review); err != nil {
+		logger.Error("Failed to process deployment review",
+			zap.Error(err),
+			zap.Int64("runID", review.RunID),
+			zap.String("repository", review.Repository))
+	} else {
+		logger.Debug("Successfully processed deployment review",
+			zap.Int64("runID", review.RunID),
+			zap.String("action", string(review.Action)))
+	}
+}
+
+// processDeploymentProtectionRuleEvent handles deployment_protection_rule events
+func processDeploymentProtectionRuleEvent(c *gin.Context, body []byte, processor *metrics.MetricsProcessor, logger *zap.Logger) {
+	var event GitHubDeploymentProtectionRuleEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		logger.Error("Failed to parse deployment_protection_rule event", zap.Error(err))
+		c.JSON(400, gin.H{"error": "Failed to parse deployment_protection_rule event"})
+		return
+	}
+
+	// The event names the waiting run only in its callback URL
+	match := callbackRunIDRegex.FindStringSubmatch(event.DeploymentCallbackURL)
+	if match == nil {
+		logger.Debug("Ignoring deployment_protection_rule event without run",
+			zap.String("callbackURL", event.DeploymentCallbackURL))
+		return
+	}
+	runID, _ := strconv.ParseInt(match[1], 10, 64)
+
+	// Create deployment protection rule object
+	rule := metrics.DeploymentProtectionRule{
+		Repository:  event.Repository.FullName,
+		Environment: event.Environment,
+		RunID:       runID,
+	}
+
+	// Process the deployment protection rule
+	if err := processor.ProcessDeploymentProtectionRule(c.Request.Context(), rule); err != nil {
+		logger.Error("Failed to process deployment protection rule",
+			zap.Error(err),
+			zap.Int64("runID", rule.RunID),
+			zap.String("repository", rule.Repository))
+	} else {
+		logger.Debug("Successfully processed deployment protection rule",
+			zap.Int64("runID", rule.RunID),
+			zap.String("environment", rule.Environment))
+	}
+}
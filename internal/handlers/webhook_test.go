@@ -7,11 +7,13 @@ import (
 	"encoding/hex"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"gh-actions-exporter/internal/metrics"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 )
@@ -296,3 +298,189 @@ func TestVerifyGitHubSignature(t *testing.T) {
 	assert.True(t, verifyGitHubSignature(payload, validSignature, ""))
 	assert.True(t, verifyGitHubSignature(payload, "", ""))
 }
+
+func TestWebhookHandler_PullRequestRun(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	logger := zap.NewNop()
+	registry := prometheus.NewRegistry()
+	processor := metrics.NewMetricsProcessor(logger, registry)
+	router.POST("/webhook", func(c *gin.Context) {
+		WebhookHandler(c, processor, logger, "")
+	})
+
+	payload := `{
+		"action":"completed",
+		"workflow_run":{
+			"id":791,
+			"name":"CI",
+			"status":"completed",
+			"conclusion":"success",
+			"run_attempt":1,
+			"run_started_at":"2023-01-01T12:00:00Z",
+			"updated_at":"2023-01-01T12:10:00Z",
+			"head_branch":"feature/login",
+			"event":"pull_request",
+			"head_sha":"ccb5820ced9479c074f688cc328bf03f341a511f",
+			"pull_requests":[{"number":42,"head":{"ref":"feature/login"},"base":{"ref":"main"}}]
+		},
+		"repository":{
+			"full_name":"owner/repo"
+		}
+	}`
+	req, _ := http.NewRequest("POST", "/webhook", bytes.NewBufferString(payload))
+	req.Header.Set("X-GitHub-Event", "workflow_run")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	expected := `
+# HELP github_workflow_pull_request_runs_total Total number of completed workflow runs triggered by pull requests, by base branch
+# TYPE github_workflow_pull_request_runs_total counter
+github_workflow_pull_request_runs_total{base_branch="main",conclusion="success",origin="same_repo",repository="owner/repo",workflow="CI"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "github_workflow_pull_request_runs_total"))
+}
+
+func TestWebhookHandler_WorkflowJob(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	logger := zap.NewNop()
+	registry := prometheus.NewRegistry()
+	processor := metrics.NewMetricsProcessor(logger, registry)
+	router.POST("/webhook", func(c *gin.Context) {
+		WebhookHandler(c, processor, logger, "")
+	})
+
+	payload := `{
+		"action":"completed",
+		"workflow_job":{
+			"id":1001,
+			"run_id":792,
+			"run_attempt":1,
+			"name":"build",
+			"workflow_name":"CI",
+			"head_branch":"main",
+			"status":"completed",
+			"conclusion":"failure",
+			"created_at":"2023-01-01T12:00:00Z",
+			"started_at":"2023-01-01T12:00:30Z",
+			"completed_at":"2023-01-01T12:05:30Z"
+		},
+		"repository":{
+			"full_name":"owner/repo"
+		}
+	}`
+	req, _ := http.NewRequest("POST", "/webhook", bytes.NewBufferString(payload))
+	req.Header.Set("X-GitHub-Event", "workflow_job")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"processed"`)
+	expected := `
+# HELP github_workflow_jobs_total Total number of completed workflow jobs, counted once per job
+# TYPE github_workflow_jobs_total counter
+github_workflow_jobs_total{conclusion="failure",job="build",matrix="",repository="owner/repo",workflow="CI"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "github_workflow_jobs_total"))
+}
+
+func TestWebhookHandler_DeploymentApprovals(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	logger := zap.NewNop()
+	registry := prometheus.NewRegistry()
+	processor := metrics.NewMetricsProcessor(logger, registry)
+	router.POST("/webhook", func(c *gin.Context) {
+		WebhookHandler(c, processor, logger, "")
+	})
+
+	post := func(event, payload string) {
+		req, _ := http.NewRequest("POST", "/webhook", bytes.NewBufferString(payload))
+		req.Header.Set("X-GitHub-Event", event)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), `"status":"processed"`)
+	}
+
+	// A job waiting on a custom protection rule learns its environment from the callback URL
+	post("workflow_job", `{
+		"action":"waiting",
+		"workflow_job":{"id":2001,"run_id":900,"run_attempt":1,"name":"deploy-staging","workflow_name":"CD","status":"waiting","created_at":"2023-01-01T12:00:00Z"},
+		"repository":{"full_name":"owner/repo"}
+	}`)
+	post("deployment_protection_rule", `{
+		"action":"requested",
+		"environment":"staging",
+		"deployment_callback_url":"https://api.github.com/repos/owner/repo/actions/runs/900/deployment_protection_rule",
+		"repository":{"full_name":"owner/repo"}
+	}`)
+
+	// A job waiting on required reviewers
+	post("deployment_review", `{
+		"action":"requested",
+		"environment":"production",
+		"since":"2023-01-01T12:00:00Z",
+		"workflow_run":{"id":900,"name":"CD","run_attempt":1,"head_branch":"main"},
+		"workflow_job_run":{"id":2002,"name":"deploy-production","environment":"production","created_at":"2023-01-01T12:00:00Z"},
+		"repository":{"full_name":"owner/repo"}
+	}`)
+
+	expected := `
+# HELP github_workflow_jobs_waiting Number of workflow jobs currently waiting on their deployment environment
+# TYPE github_workflow_jobs_waiting gauge
+github_workflow_jobs_waiting{environment="",repository="owner/repo"} 0
+github_workflow_jobs_waiting{environment="production",repository="owner/repo"} 1
+github_workflow_jobs_waiting{environment="staging",repository="owner/repo"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "github_workflow_jobs_waiting"))
+
+	post("deployment_review", `{
+		"action":"approved",
+		"environment":"production",
+		"since":"2023-01-01T12:00:00Z",
+		"workflow_run":{"id":900,"name":"CD","run_attempt":1,"head_branch":"main"},
+		"workflow_job_runs":[{"id":2002,"name":"deploy-production","environment":"production","created_at":"2023-01-01T12:00:00Z","updated_at":"2023-01-01T12:20:00Z"}],
+		"repository":{"full_name":"owner/repo"}
+	}`)
+
+	count, err := testutil.GatherAndCount(registry, "github_workflow_job_approval_wait_seconds")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == "github_workflow_job_approval_wait_seconds" {
+			histogram := family.GetMetric()[0].GetHistogram()
+			assert.Equal(t, uint64(1), histogram.GetSampleCount())
+			assert.Equal(t, 1200.0, histogram.GetSampleSum())
+		}
+	}
+}
+
+func TestWebhookHandler_InvalidWorkflowJobPayload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	logger := zap.NewNop()
+	registry := prometheus.NewRegistry()
+	processor := metrics.NewMetricsProcessor(logger, registry)
+	router.POST("/webhook", func(c *gin.Context) {
+		WebhookHandler(c, processor, logger, "")
+	})
+
+	payload := `{invalid json}`
+	req, _ := http.NewRequest("POST", "/webhook", bytes.NewBufferString(payload))
+	req.Header.Set("X-GitHub-Event", "workflow_job")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), `"error":"Failed to parse workflow_job event"`)
+}
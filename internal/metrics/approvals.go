@@ -0,0 +1,235 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DeploymentReviewAction is the action of a deployment review event
+type DeploymentReviewAction string
+
+// Constants for deployment review actions, the approved and rejected actions are also the
+// outcome label values of the approval wait histogram
+const (
+	DeploymentReviewRequested DeploymentReviewAction = "requested"
+	DeploymentReviewApproved  DeploymentReviewAction = "approved"
+	DeploymentReviewRejected  DeploymentReviewAction = "rejected"
+)
+
+// DeploymentReview represents a deployment review event, sent when jobs wait for the required
+// reviewers of an environment and when the reviewers approve or reject them
+type DeploymentReview struct {
+	Action       DeploymentReviewAction
+	Repository   string
+	Environment  string
+	RunID        int64
+	RunAttempt   int
+	WorkflowName string
+	Branch       string
+	HeadSHA      string
+	Since        time.Time // Time the review was requested
+	Jobs         []DeploymentReviewJob
+}
+
+// DeploymentReviewJob is a job waiting for a deployment review
+type DeploymentReviewJob struct {
+	ID          int64
+	Name        string
+	Environment string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time // Time of the review, for approved and rejected jobs
+}
+
+// DeploymentProtectionRule represents a deployment protection rule event, sent when a run waits
+// for a custom deployment protection rule of an environment
+type DeploymentProtectionRule struct {
+	Repository  string
+	Environment string
+	RunID       int64
+}
+
+// approvalState records a job waiting on its environment, and whether its wait was accounted
+type approvalState struct {
+	repository  string
+	environment string // Empty until an environment event names it
+	runID       int64
+	since       time.Time // Time the job started waiting
+	until       time.Time // Time the wait ended, from when the job waits for a runner
+	outcome     DeploymentReviewAction
+	lastSeen    time.Time // Wall clock time of the last event for this job
+	waiting     bool
+	done        bool // Whether the wait ended, so repeated deliveries are ignored
+}
+
+// trackApproval follows the wait of a job on its environment from its workflow job events.
+// Jobs that leave the waiting status without a review event were approved by a protection rule
+// or a wait timer, or rejected when they complete. Must be called with p.mu held.
+func (p *MetricsProcessor) trackApproval(run WorkflowRun, job WorkflowJob) {
+	switch job.Status {
+	case WorkflowRunStatusWaiting:
+		since := job.CreatedAt
+		if since.IsZero() {
+			since = p.now()
+		}
+		p.startWaiting(job.ID, run.Repository, job.RunID, "", since)
+	case WorkflowRunStatusQueued, WorkflowRunStatusInProgress:
+		// Queued deliveries carry the creation time as their start time, so the wait ends at the event
+		p.endWaiting(job.ID, DeploymentReviewApproved, p.now())
+	case WorkflowRunStatusCompleted:
+		// Cancelled jobs were not reviewed
+		outcome := DeploymentReviewRejected
+		if job.Conclusion == WorkflowRunConclusionCancelled || job.Conclusion == WorkflowRunConclusionSkipped {
+			outcome = ""
+		}
+		p.endWaiting(job.ID, outcome, job.CompletedAt)
+	}
+}
+
+// startWaiting records that the job waits on its environment. A known environment replaces an
+// unknown one. Must be called with p.mu held.
+func (p *MetricsProcessor) startWaiting(jobID int64, repository string, runID int64, environment string, since time.Time) {
+	state, ok := p.approvals[jobID]
+	if !ok {
+		state = &approvalState{repository: repository, runID: runID, since: since}
+		p.approvals[jobID] = state
+	}
+	state.lastSeen = p.now()
+	if state.done {
+		return
+	}
+
+	if !state.waiting {
+		state.waiting = true
+		state.environment = environment
+		p.workflowJobsWaiting.WithLabelValues(state.repository, state.environment).Inc()
+	} else if environment != "" && environment != state.environment {
+		p.workflowJobsWaiting.WithLabelValues(state.repository, state.environment).Dec()
+		state.environment = environment
+		p.workflowJobsWaiting.WithLabelValues(state.repository, state.environment).Inc()
+	}
+}
+
+// endWaiting ends the wait of a waiting job and observes it with the outcome, unless the outcome
+// is empty. Must be called with p.mu held.
+func (p *MetricsProcessor) endWaiting(jobID int64, outcome DeploymentReviewAction, at time.Time) {
+	state, ok := p.approvals[jobID]
+	if !ok || !state.waiting {
+		return
+	}
+	state.lastSeen = p.now()
+	state.waiting = false
+	state.done = true
+	state.until = at
+	state.outcome = outcome
+	p.workflowJobsWaiting.WithLabelValues(state.repository, state.environment).Dec()
+
+	if outcome == "" || at.IsZero() || at.Before(state.since) {
+		return
+	}
+	p.workflowJobApprovalWait.WithLabelValues(state.repository, state.environment, string(outcome)).Observe(at.Sub(state.since).Seconds())
+}
+
+// ProcessDeploymentReview processes a deployment review event. Requested reviews name the
+// environment of the waiting jobs, approved and rejected reviews end their wait.
+func (p *MetricsProcessor) ProcessDeploymentReview(ctx context.Context, review DeploymentReview) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.prune(p.now())
+
+	run, reason := p.jobRun(WorkflowJob{
+		RunID:        review.RunID,
+		RunAttempt:   review.RunAttempt,
+		WorkflowName: review.WorkflowName,
+		Repository:   review.Repository,
+		Branch:       review.Branch,
+		HeadSHA:      review.HeadSHA,
+	})
+	if reason != "" {
+		p.droppedEvents.WithLabelValues(reason).Inc()
+		p.logger.Debug("Deployment review dropped",
+			zap.Int64("runID", review.RunID),
+			zap.String("repository", review.Repository),
+			zap.String("reason", reason))
+		return nil
+	}
+
+	for _, job := range review.Jobs {
+		environment := job.Environment
+		if environment == "" {
+			environment = review.Environment
+		}
+		since := job.CreatedAt
+		if since.IsZero() {
+			since = review.Since
+		}
+
+		switch review.Action {
+		case DeploymentReviewRequested:
+			if since.IsZero() {
+				since = p.now()
+			}
+			p.startWaiting(job.ID, run.Repository, review.RunID, environment, since)
+		case DeploymentReviewApproved, DeploymentReviewRejected:
+			// Jobs that started waiting before the exporter did are tracked from the review
+			if _, ok := p.approvals[job.ID]; ok || !since.IsZero() {
+				p.startWaiting(job.ID, run.Repository, review.RunID, environment, since)
+			}
+
+			at := job.UpdatedAt
+			if at.IsZero() {
+				at = p.now()
+			}
+			p.endWaiting(job.ID, review.Action, at)
+		default:
+			p.logger.Debug("Ignoring deployment review action", zap.String("action", string(review.Action)))
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// ProcessDeploymentProtectionRule processes a deployment protection rule event. The event does
+// not name the job, so it only sets the environment when a single job of the run is waiting and
+// its environment is not known yet.
+func (p *MetricsProcessor) ProcessDeploymentProtectionRule(ctx context.Context, rule DeploymentProtectionRule) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.prune(p.now())
+
+	var waiting []int64
+	for jobID, state := range p.approvals {
+		if state.runID == rule.RunID && state.waiting {
+			waiting = append(waiting, jobID)
+		}
+	}
+	if len(waiting) != 1 {
+		p.logger.Debug("Ignoring deployment protection rule without a single waiting job",
+			zap.Int64("runID", rule.RunID),
+			zap.Int("waiting", len(waiting)))
+		return nil
+	}
+
+	if state := p.approvals[waiting[0]]; state.environment == "" {
+		p.startWaiting(waiting[0], state.repository, state.runID, rule.Environment, state.since)
+	}
+	return nil
+}
+
+// pruneApprovals stops counting jobs that did not receive an event within the run timeout as
+// waiting, and forgets jobs after the retention period. Must be called with p.mu held.
+func (p *MetricsProcessor) pruneApprovals(now time.Time) {
+	for jobID, state := range p.approvals {
+		if state.waiting && p.cfg.RunTimeout > 0 && now.Sub(state.lastSeen) > p.cfg.RunTimeout {
+			p.endWaiting(jobID, "", time.Time{})
+		}
+		if now.Sub(state.lastSeen) > runTrackingRetention {
+			p.endWaiting(jobID, "", time.Time{})
+			delete(p.approvals, jobID)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import "time"
+
+// failedRunRetention bounds how long a failed run is remembered while waiting for a successful re-run
+const failedRunRetention = 7 * 24 * time.Hour
+
+// isFailedConclusion reports whether the conclusion counts as a failed attempt
+func isFailedConclusion(conclusion WorkflowRunConclusion) bool {
+	switch conclusion {
+	case WorkflowRunConclusionFailure, WorkflowRunConclusionTimedOut, WorkflowRunConclusionStartupFailure:
+		return true
+	}
+	return false
+}
+
+// trackAttempt updates the flakiness signal of a run. completed tells whether this event is
+// the first completion of the attempt. Must be called with p.mu held.
+func (p *MetricsProcessor) trackAttempt(run WorkflowRun, completed bool) {
+	if !completed {
+		return
+	}
+
+	// Remember failed runs, so that a later successful attempt can be flagged as flaky
+	if isFailedConclusion(run.Conclusion) {
+		p.failedRuns[run.ID] = p.now()
+		return
+	}
+
+	if run.Conclusion == WorkflowRunConclusionSuccess && run.RunAttempt > 1 {
+		if _, failed := p.failedRuns[run.ID]; failed {
+			delete(p.failedRuns, run.ID)
+			incWithExemplar(p.workflowRunsFlaky.WithLabelValues(run.Repository, run.Name, string(run.BranchClass()), string(run.Origin())), runExemplar(run))
+		}
+	}
+}
+
+// trackRerun counts a re-run on the first event of a new attempt. Attempts are remembered as
+// long as failed runs, so that late deliveries for an attempt whose phases were already pruned
+// are not counted again. Must be called with p.mu held.
+func (p *MetricsProcessor) trackRerun(run WorkflowRun, key runKey) {
+	if run.RunAttempt <= 1 {
+		return
+	}
+	if _, seen := p.reruns[key]; !seen {
+		incWithExemplar(p.workflowRunReruns.WithLabelValues(run.Repository, run.Name, string(run.BranchClass()), string(run.Origin())), runExemplar(run))
+	}
+	p.reruns[key] = p.now()
+}
+
+// pruneFailedRuns forgets failed runs that were not re-run, and re-run attempts that did not
+// receive an event, within the retention period. Must be called with p.mu held.
+func (p *MetricsProcessor) pruneFailedRuns(now time.Time) {
+	for id, failedAt := range p.failedRuns {
+		if now.Sub(failedAt) > failedRunRetention {
+			delete(p.failedRuns, id)
+		}
+	}
+	for key, seenAt := range p.reruns {
+		if now.Sub(seenAt) > failedRunRetention {
+			delete(p.reruns, key)
+		}
+	}
+}
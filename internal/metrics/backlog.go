@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// Backlog is the number of queued and in progress jobs
+type Backlog struct {
+	Labels     []string          `json:"labels,omitempty"` // Runner labels the backlog was requested for
+	Queued     int               `json:"queued"`
+	InProgress int               `json:"in_progress"`
+	LabelSets  []BacklogLabelSet `json:"label_sets"`
+}
+
+// BacklogLabelSet is the number of queued and in progress jobs requesting a runner label set
+type BacklogLabelSet struct {
+	Labels     string `json:"labels"` // Normalised runner labels, as in the runner_labels label
+	Queued     int    `json:"queued"`
+	InProgress int    `json:"in_progress"`
+}
+
+// trackBacklog moves the job between the queued and in progress jobs of its runner label set.
+// Jobs are queued until a runner picks them up and in progress until they complete; events
+// delivered late do not move a job back. Must be called with p.mu held.
+func (p *MetricsProcessor) trackBacklog(job WorkflowJob, state *jobState) {
+	switch job.Status {
+	case WorkflowRunStatusQueued:
+		if !state.queued && !state.dequeued {
+			p.enqueueJob(state, runnerLabels(job.Labels))
+		}
+	case WorkflowRunStatusInProgress:
+		state.dequeued = true
+		p.dequeueJob(state)
+		if !state.running && !state.completed {
+			p.startJob(state, runnerLabels(job.Labels))
+		}
+	case WorkflowRunStatusCompleted:
+		state.dequeued = true
+		p.dequeueJob(state)
+		p.finishJob(state)
+	default:
+		// Jobs waiting on their environment do not wait for a runner yet
+		p.dequeueJob(state)
+	}
+}
+
+// enqueueJob adds the job to the backlog of the runner label set. Must be called with p.mu held.
+func (p *MetricsProcessor) enqueueJob(state *jobState, labels string) {
+	state.queued = true
+	state.runnerLabels = labels
+	p.backlog[labels]++
+	p.jobsQueued.WithLabelValues(labels).Inc()
+}
+
+// dequeueJob removes the job from the backlog, if it is queued. Must be called with p.mu held.
+func (p *MetricsProcessor) dequeueJob(state *jobState) {
+	if !state.queued {
+		return
+	}
+	state.queued = false
+	p.jobsQueued.WithLabelValues(state.runnerLabels).Dec()
+	if p.backlog[state.runnerLabels]--; p.backlog[state.runnerLabels] <= 0 {
+		delete(p.backlog, state.runnerLabels)
+	}
+}
+
+// startJob counts the job as in progress for the runner label set. Must be called with p.mu held.
+func (p *MetricsProcessor) startJob(state *jobState, labels string) {
+	state.running = true
+	state.runnerLabels = labels
+	p.inProgress[labels]++
+	p.jobsInProgress.WithLabelValues(labels).Inc()
+}
+
+// finishJob no longer counts the job as in progress, if it is. Must be called with p.mu held.
+func (p *MetricsProcessor) finishJob(state *jobState) {
+	if !state.running {
+		return
+	}
+	state.running = false
+	p.jobsInProgress.WithLabelValues(state.runnerLabels).Dec()
+	if p.inProgress[state.runnerLabels]--; p.inProgress[state.runnerLabels] <= 0 {
+		delete(p.inProgress, state.runnerLabels)
+	}
+}
+
+// pruneBacklog removes queued and in progress jobs that did not receive an event within the run
+// timeout, such as jobs whose completion was lost. Must be called with p.mu held.
+func (p *MetricsProcessor) pruneBacklog(now time.Time) {
+	if p.cfg.RunTimeout <= 0 {
+		return
+	}
+	for _, state := range p.jobs {
+		if now.Sub(state.lastSeen) > p.cfg.RunTimeout {
+			p.dequeueJob(state)
+			p.finishJob(state)
+		}
+	}
+}
+
+// Backlog returns the queued and in progress jobs that a runner with the given labels could pick
+// up, that is the jobs whose requested labels are all among them, by runner label set. Without
+// labels all jobs are returned. Labels are compared case insensitively.
+func (p *MetricsProcessor) Backlog(labels []string) Backlog {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var runner []string
+	if normalised := runnerLabels(labels); normalised != "" {
+		runner = strings.Split(normalised, ",")
+	}
+
+	sets := make(map[string]*BacklogLabelSet)
+	labelSet := func(set string) *BacklogLabelSet {
+		if _, ok := sets[set]; !ok {
+			sets[set] = &BacklogLabelSet{Labels: set}
+		}
+		return sets[set]
+	}
+	for set, queued := range p.backlog {
+		labelSet(set).Queued = queued
+	}
+	for set, inProgress := range p.inProgress {
+		labelSet(set).InProgress = inProgress
+	}
+
+	backlog := Backlog{Labels: runner, LabelSets: []BacklogLabelSet{}}
+	for set, counts := range sets {
+		if runner != nil && !labelSetMatches(set, runner) {
+			continue
+		}
+		backlog.Queued += counts.Queued
+		backlog.InProgress += counts.InProgress
+		backlog.LabelSets = append(backlog.LabelSets, *counts)
+	}
+	slices.SortFunc(backlog.LabelSets, func(a, b BacklogLabelSet) int {
+		return strings.Compare(a.Labels, b.Labels)
+	})
+	return backlog
+}
+
+// labelSetMatches reports whether every label of the normalised label set is among the runner labels
+func labelSetMatches(set string, runner []string) bool {
+	if set == "" {
+		return true
+	}
+	for _, label := range strings.Split(set, ",") {
+		if !slices.Contains(runner, label) {
+			return false
+		}
+	}
+	return true
+}
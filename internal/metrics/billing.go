@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// DefaultRunnerGroupPrice is the SelfHostedPricePerHour key used for runner groups without their own price
+const DefaultRunnerGroupPrice = "*"
+
+// Constants for the operating systems of GitHub hosted runners
+const (
+	RunnerOSLinux   = "linux"
+	RunnerOSWindows = "windows"
+	RunnerOSMacOS   = "macos"
+)
+
+// BillingConfig is the price table used to estimate the billable minutes and cost of workflow jobs
+type BillingConfig struct {
+	// PricePerMinute is the price of a minute on a standard GitHub hosted Linux runner
+	PricePerMinute float64 `yaml:"price_per_minute"`
+
+	// OSMultipliers scale the minutes of standard GitHub hosted runners by operating system
+	OSMultipliers map[string]float64 `yaml:"os_multipliers"`
+
+	// SKUPrices are the per minute prices of larger runners, by runner label
+	SKUPrices map[string]float64 `yaml:"sku_prices"`
+
+	// SelfHostedPricePerHour is the cost of an hour of busy time on self-hosted runners, by
+	// runner group, with DefaultRunnerGroupPrice as the fallback
+	SelfHostedPricePerHour map[string]float64 `yaml:"self_hosted_price_per_hour"`
+}
+
+// defaultBillingConfig returns the list prices of standard GitHub hosted runners
+func defaultBillingConfig() BillingConfig {
+	return BillingConfig{
+		PricePerMinute: 0.008,
+		OSMultipliers: map[string]float64{
+			RunnerOSLinux:   1,
+			RunnerOSWindows: 2,
+			RunnerOSMacOS:   10,
+		},
+	}
+}
+
+// validate checks the price table for negative prices
+func (c BillingConfig) validate() error {
+	if c.PricePerMinute < 0 {
+		return fmt.Errorf("billing price_per_minute must not be negative")
+	}
+	for name, prices := range map[string]map[string]float64{
+		"os_multipliers":             c.OSMultipliers,
+		"sku_prices":                 c.SKUPrices,
+		"self_hosted_price_per_hour": c.SelfHostedPricePerHour,
+	} {
+		for key, price := range prices {
+			if price < 0 {
+				return fmt.Errorf("billing %s: %q must not be negative", name, key)
+			}
+		}
+	}
+	return nil
+}
+
+// runnerOS determines the operating system of a GitHub hosted runner from the labels requested
+// by the job, e.g. "windows-latest" or "macos-14", defaulting to Linux
+func runnerOS(labels []string) string {
+	for _, label := range labels {
+		label = strings.ToLower(label)
+		switch {
+		case strings.HasPrefix(label, RunnerOSWindows):
+			return RunnerOSWindows
+		case strings.HasPrefix(label, RunnerOSMacOS):
+			return RunnerOSMacOS
+		}
+	}
+	return RunnerOSLinux
+}
+
+// skuPrice returns the larger runner SKU requested by the job and its price per minute
+func (c BillingConfig) skuPrice(labels []string) (string, float64, bool) {
+	for _, label := range labels {
+		for sku, price := range c.SKUPrices {
+			if strings.EqualFold(label, sku) {
+				return sku, price, true
+			}
+		}
+	}
+	return "", 0, false
+}
+
+// accountBilling estimates the billable minutes and the cost of a completed job. GitHub hosted
+// jobs are rounded up to the next minute, standard runners are billed at the base price scaled
+// by the OS multiplier and larger runners at the price of their SKU. Self-hosted runners are not
+// billed by GitHub, their busy time is priced per hour of their runner group and they have no
+// SKU. Must be called with p.mu held.
+func (p *MetricsProcessor) accountBilling(key jobSeriesKey, job WorkflowJob) {
+	if job.StartedAt.IsZero() || !job.CompletedAt.After(job.StartedAt) {
+		return
+	}
+	duration := job.CompletedAt.Sub(job.StartedAt)
+	billing := p.cfg.Billing
+
+	if p.runnerType(job) == RunnerTypeSelfHosted {
+		price, ok := billing.SelfHostedPricePerHour[job.RunnerGroupName]
+		if !ok {
+			price, ok = billing.SelfHostedPricePerHour[DefaultRunnerGroupPrice]
+		}
+		if ok {
+			p.estimatedCost.WithLabelValues(key.repository, key.workflow, string(RunnerTypeSelfHosted), "", job.RunnerGroupName).Add(duration.Hours() * price)
+		}
+		return
+	}
+
+	minutes := math.Ceil(duration.Minutes())
+	sku, price, ok := billing.skuPrice(job.Labels)
+	billable := minutes
+	if !ok {
+		sku = runnerOS(job.Labels)
+		multiplier, ok := billing.OSMultipliers[sku]
+		if !ok {
+			multiplier = 1
+		}
+		billable = minutes * multiplier
+		price = billing.PricePerMinute
+	}
+
+	p.billableMinutes.WithLabelValues(key.repository, key.workflow, string(RunnerTypeGitHubHosted), sku).Add(billable)
+	p.estimatedCost.WithLabelValues(key.repository, key.workflow, string(RunnerTypeGitHubHosted), sku, job.RunnerGroupName).Add(billable * price)
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import "strings"
+
+// BranchClass groups branches into a small, bounded set of values that is safe to use as a label
+type BranchClass string
+
+// Constants for branch classes
+const (
+	BranchClassDefault BranchClass = "default"
+	BranchClassRelease BranchClass = "release"
+	BranchClassTag     BranchClass = "tag"
+	BranchClassFeature BranchClass = "feature"
+)
+
+// releaseBranchPrefixes lists the branch name prefixes treated as release branches
+var releaseBranchPrefixes = []string{"release/", "release-", "releases/", "hotfix/"}
+
+// BranchClass classifies the branch or tag the workflow run was triggered for
+func (r WorkflowRun) BranchClass() BranchClass {
+	if r.branchClass != "" {
+		return r.branchClass
+	}
+
+	if r.RefType == "tag" {
+		return BranchClassTag
+	}
+
+	// Fall back to the common default branch names when the payload did not carry one
+	if r.DefaultBranch != "" {
+		if r.Branch == r.DefaultBranch {
+			return BranchClassDefault
+		}
+	} else if r.Branch == "main" || r.Branch == "master" {
+		return BranchClassDefault
+	}
+
+	for _, prefix := range releaseBranchPrefixes {
+		if strings.HasPrefix(r.Branch, prefix) {
+			return BranchClassRelease
+		}
+	}
+
+	return BranchClassFeature
+}
+
+// IsPullRequest reports whether the workflow run was triggered by a pull request
+func (r WorkflowRun) IsPullRequest() bool {
+	return r.Trigger == "pull_request" || r.Trigger == "pull_request_target"
+}
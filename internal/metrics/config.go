@@ -0,0 +1,247 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Config holds the tunable settings of the MetricsProcessor
+type Config struct {
+	// DurationBuckets are the histogram buckets, in seconds, used for workflow run durations
+	DurationBuckets []float64 `yaml:"duration_buckets"`
+
+	// QueueBuckets are the histogram buckets, in seconds, used for workflow run queue times
+	QueueBuckets []float64 `yaml:"queue_buckets"`
+
+	// SeriesTTL is how long a per-branch workflow series is kept without updates; zero keeps series forever
+	SeriesTTL time.Duration `yaml:"series_ttl"`
+
+	// SeriesTTLByBranchClass overrides SeriesTTL for specific branch classes
+	SeriesTTLByBranchClass map[BranchClass]time.Duration `yaml:"series_ttl_by_branch_class"`
+
+	// MaxSeries limits the number of per-branch workflow series overall; zero means no limit
+	MaxSeries int `yaml:"max_series"`
+
+	// MaxSeriesPerRepository limits the number of per-branch workflow series of a repository; zero means no limit
+	MaxSeriesPerRepository int `yaml:"max_series_per_repository"`
+
+	// RunInfoLimit is the number of latest runs per series exposed by the run info metric; zero disables it
+	RunInfoLimit int `yaml:"run_info_limit"`
+
+	// RunTimeout is how long a queued or in progress run is tracked without receiving an event
+	// before it is considered lost; zero tracks runs until they complete
+	RunTimeout time.Duration `yaml:"run_timeout"`
+
+	// RunnerTTL is how long the per-runner series of a self-hosted runner are kept after its last
+	// job, so that ephemeral runners do not leave series behind; zero keeps them forever
+	RunnerTTL time.Duration `yaml:"runner_ttl"`
+
+	// MaxStepsPerJob limits the number of step names exposed per job; zero means no limit
+	MaxStepsPerJob int `yaml:"max_steps_per_job"`
+
+	// Matrix controls how the names of matrix jobs are split into labels
+	Matrix MatrixConfig `yaml:"matrix"`
+
+	// WorkflowLabel selects the value of the workflow label: the display "name" (default), or the
+	// stable workflow "id" or file "path" that survive renames
+	WorkflowLabel string `yaml:"workflow_label"`
+
+	// RelabelConfigs rewrite or drop workflow runs before metrics are updated
+	RelabelConfigs []RelabelConfig `yaml:"relabel_configs"`
+
+	// Filters select the events that update metrics, they are evaluated before relabeling
+	Filters FiltersConfig `yaml:"filters"`
+
+	// Billing is the price table used to estimate the cost of workflow jobs
+	Billing BillingConfig `yaml:"billing"`
+}
+
+// Option customizes the configuration of a MetricsProcessor
+type Option func(*Config)
+
+// DefaultConfig returns the configuration used when no options are given
+func DefaultConfig() Config {
+	return Config{
+		DurationBuckets: []float64{30, 60, 120, 300, 600, 900, 1200, 1800, 2700, 3600, 5400, 7200},
+		QueueBuckets:    []float64{5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+		RunInfoLimit:    5,
+		WorkflowLabel:   WorkflowLabelName,
+		RunTimeout:      24 * time.Hour,
+		RunnerTTL:       24 * time.Hour,
+		MaxStepsPerJob:  50,
+		Matrix:          MatrixConfig{MaxCombinationsPerJob: 20},
+		Billing:         defaultBillingConfig(),
+	}
+}
+
+// Validate checks the configuration for errors
+func (c Config) Validate() error {
+	if err := validateBuckets("duration", c.DurationBuckets); err != nil {
+		return err
+	}
+	if err := validateBuckets("queue", c.QueueBuckets); err != nil {
+		return err
+	}
+	for class := range c.SeriesTTLByBranchClass {
+		switch class {
+		case BranchClassDefault, BranchClassRelease, BranchClassTag, BranchClassFeature:
+		default:
+			return fmt.Errorf("series TTL of unknown branch class %q", class)
+		}
+	}
+	if err := validateWorkflowLabel(c.WorkflowLabel); err != nil {
+		return err
+	}
+	if _, err := compileRelabelConfigs(c.RelabelConfigs); err != nil {
+		return err
+	}
+	if _, err := compileFilters(c.Filters); err != nil {
+		return err
+	}
+	if _, err := compileMatrixDimensions(c.Matrix); err != nil {
+		return err
+	}
+	if err := c.Billing.validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateBuckets checks that histogram buckets are given in strictly increasing order
+func validateBuckets(name string, buckets []float64) error {
+	if len(buckets) == 0 {
+		return fmt.Errorf("no %s buckets given", name)
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("%s buckets must be in increasing order", name)
+		}
+	}
+	return nil
+}
+
+// WithConfig replaces the whole processor configuration
+func WithConfig(cfg Config) Option {
+	return func(c *Config) {
+		*c = cfg
+	}
+}
+
+// WithDurationBuckets sets the histogram buckets used for workflow run durations
+func WithDurationBuckets(buckets []float64) Option {
+	return func(c *Config) {
+		c.DurationBuckets = buckets
+	}
+}
+
+// WithQueueBuckets sets the histogram buckets used for workflow run queue times
+func WithQueueBuckets(buckets []float64) Option {
+	return func(c *Config) {
+		c.QueueBuckets = buckets
+	}
+}
+
+// WithSeriesTTL sets how long per-branch workflow series are kept without updates, optionally
+// overridden per branch class
+func WithSeriesTTL(ttl time.Duration, byBranchClass map[BranchClass]time.Duration) Option {
+	return func(c *Config) {
+		c.SeriesTTL = ttl
+		c.SeriesTTLByBranchClass = byBranchClass
+	}
+}
+
+// WithSeriesLimits sets the cardinality limits of the per-branch workflow series
+func WithSeriesLimits(maxSeries, maxSeriesPerRepository int) Option {
+	return func(c *Config) {
+		c.MaxSeries = maxSeries
+		c.MaxSeriesPerRepository = maxSeriesPerRepository
+	}
+}
+
+// WithRunTimeout sets how long a queued or in progress run is tracked without receiving an event
+func WithRunTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.RunTimeout = timeout
+	}
+}
+
+// WithRunnerTTL sets how long the per-runner series of self-hosted runners are kept after their last job
+func WithRunnerTTL(ttl time.Duration) Option {
+	return func(c *Config) {
+		c.RunnerTTL = ttl
+	}
+}
+
+// WithWorkflowLabel selects the value of the workflow label: "name", "id" or "path"
+func WithWorkflowLabel(label string) Option {
+	return func(c *Config) {
+		c.WorkflowLabel = label
+	}
+}
+
+// WithRelabelConfigs sets the relabel rules applied to workflow runs
+func WithRelabelConfigs(configs []RelabelConfig) Option {
+	return func(c *Config) {
+		c.RelabelConfigs = configs
+	}
+}
+
+// WithFilters sets the filters that select the events updating metrics
+func WithFilters(filters FiltersConfig) Option {
+	return func(c *Config) {
+		c.Filters = filters
+	}
+}
+
+// WithRunInfoLimit sets the number of latest runs per series exposed by the run info metric
+func WithRunInfoLimit(limit int) Option {
+	return func(c *Config) {
+		c.RunInfoLimit = limit
+	}
+}
+
+// WithMaxStepsPerJob sets the number of step names exposed per job
+func WithMaxStepsPerJob(limit int) Option {
+	return func(c *Config) {
+		c.MaxStepsPerJob = limit
+	}
+}
+
+// WithMatrix sets how the names of matrix jobs are split into labels
+func WithMatrix(matrix MatrixConfig) Option {
+	return func(c *Config) {
+		c.Matrix = matrix
+	}
+}
+
+// WithBilling sets the price table used to estimate the cost of workflow jobs
+func WithBilling(billing BillingConfig) Option {
+	return func(c *Config) {
+		c.Billing = billing
+	}
+}
+
+// seriesTTL returns the TTL that applies to series of the given branch class
+func (c Config) seriesTTL(class BranchClass) time.Duration {
+	if ttl, ok := c.SeriesTTLByBranchClass[class]; ok {
+		return ttl
+	}
+	return c.SeriesTTL
+}
+
+// mergeBuckets returns the sorted union of the given bucket lists
+func mergeBuckets(lists ...[]float64) []float64 {
+	seen := make(map[float64]bool)
+	var merged []float64
+	for _, list := range lists {
+		for _, b := range list {
+			if !seen[b] {
+				seen[b] = true
+				merged = append(merged, b)
+			}
+		}
+	}
+	sort.Float64s(merged)
+	return merged
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// runExemplar returns the exemplar labels linking an observation to a workflow run. The URL
+// is left out when the labels would exceed the exemplar size limit.
+func runExemplar(run WorkflowRun) prometheus.Labels {
+	exemplar := prometheus.Labels{"run_id": strconv.FormatInt(run.ID, 10)}
+	if run.HTMLURL == "" {
+		return exemplar
+	}
+
+	size := utf8.RuneCountInString("run_id") + utf8.RuneCountInString(exemplar["run_id"]) +
+		utf8.RuneCountInString("html_url") + utf8.RuneCountInString(run.HTMLURL)
+	if size <= prometheus.ExemplarMaxRunes {
+		exemplar["html_url"] = run.HTMLURL
+	}
+
+	return exemplar
+}
+
+// observeWithExemplar observes the value with the exemplar when the observer supports it
+func observeWithExemplar(observer prometheus.Observer, value float64, exemplar prometheus.Labels) {
+	if eo, ok := observer.(prometheus.ExemplarObserver); ok {
+		eo.ObserveWithExemplar(value, exemplar)
+		return
+	}
+	observer.Observe(value)
+}
+
+// incWithExemplar increments the counter with the exemplar
+func incWithExemplar(counter prometheus.Counter, exemplar prometheus.Labels) {
+	if ea, ok := counter.(prometheus.ExemplarAdder); ok {
+		ea.AddWithExemplar(1, exemplar)
+		return
+	}
+	counter.Inc()
+}
@@ -20,17 +20,19 @@ type MetricsExposer struct {
 // NewMetricsExposer creates a new metrics exposer
 func NewMetricsExposer(logger *zap.Logger, registry *prometheus.Registry) *MetricsExposer {
 	return &MetricsExposer{
-		logger:         logger,
-		registry:       registry,
-		metricsHandler: promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		logger:   logger,
+		registry: registry,
+		metricsHandler: promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+			// Negotiate the OpenMetrics format, so that exemplars can be scraped
+			EnableOpenMetrics: true,
+		}),
 	}
 }
 
 // RegisterRoutes registers the metrics endpoint with the provided router
 func (e *MetricsExposer) WithMetricsEndpoint(router *gin.Engine) {
 	router.GET("/metrics", func(c *gin.Context) {
-		// Set the Prometheus content type header
-		c.Header("Content-Type", "text/plain; version=0.0.4")
+		// The handler sets the content type negotiated from the Accept header
 		e.metricsHandler.ServeHTTP(c.Writer, c.Request)
 	})
 
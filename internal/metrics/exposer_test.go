@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestMetricsEndpoint_OpenMetricsExemplars(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry)
+	exposer := NewMetricsExposer(logger, registry)
+
+	router := gin.New()
+	exposer.WithMetricsEndpoint(router)
+
+	endTime := time.Now()
+	err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+		ID:         12345,
+		Name:       "exemplar-test",
+		Repository: "myorg/myrepo",
+		Status:     WorkflowRunStatusCompleted,
+		Conclusion: WorkflowRunConclusionSuccess,
+		RunAttempt: 1,
+		StartedAt:  endTime.Add(-time.Minute),
+		UpdatedAt:  endTime,
+		Branch:     "main",
+		Trigger:    "push",
+		RefType:    "branch",
+		HTMLURL:    "https://github.com/myorg/myrepo/actions/runs/12345",
+	})
+	require.NoError(t, err)
+
+	// OpenMetrics is negotiated and carries exemplars
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/openmetrics-text")
+	assert.Regexp(t, `github_workflow_runs_total\{[^}]*\} 1\.0 # \{[^}]*run_id="12345"`, w.Body.String())
+	assert.Regexp(t, `github_workflow_run_duration_seconds_bucket\{[^}]*\} 1 # \{[^}]*html_url="https://github.com/myorg/myrepo/actions/runs/12345"`, w.Body.String())
+
+	// The classic text format is still served by default
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, w.Body.String(), "github_workflow_runs_total")
+}
+
+func TestRunExemplar(t *testing.T) {
+	exemplar := runExemplar(WorkflowRun{ID: 42, HTMLURL: "https://github.com/o/r/actions/runs/42"})
+	assert.Equal(t, prometheus.Labels{"run_id": "42", "html_url": "https://github.com/o/r/actions/runs/42"}, exemplar)
+
+	// URLs that do not fit in an exemplar are left out
+	longURL := "https://github.com/" + strings.Repeat("a", 120) + "/actions/runs/42"
+	exemplar = runExemplar(WorkflowRun{ID: 42, HTMLURL: longURL})
+	assert.Equal(t, prometheus.Labels{"run_id": "42"}, exemplar)
+}
+
+func TestExternalMetricsAPI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry)
+	exposer := NewMetricsExposer(logger, registry)
+
+	router := gin.New()
+	exposer.WithExternalMetricsAPI(router, processor)
+
+	for id, status := range map[int64]WorkflowRunStatus{
+		1: WorkflowRunStatusQueued,
+		2: WorkflowRunStatusQueued,
+		3: WorkflowRunStatusInProgress,
+	} {
+		require.NoError(t, processor.ProcessWorkflowJob(context.Background(), WorkflowJob{
+			ID:           id,
+			RunID:        100,
+			Name:         "build",
+			WorkflowName: "CI",
+			Repository:   "myorg/myrepo",
+			Status:       status,
+			Labels:       []string{"self-hosted", "linux"},
+		}))
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Discovery lists the served metrics
+	w := get("/apis/external.metrics.k8s.io/v1beta1")
+	assert.Equal(t, 200, w.Code)
+	var resources apiResourceList
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resources))
+	assert.Equal(t, "external.metrics.k8s.io/v1beta1", resources.GroupVersion)
+	assert.Len(t, resources.Resources, 2)
+
+	for _, tt := range []struct {
+		path     string
+		expected string
+	}{
+		{path: "/namespaces/runners/github_actions_jobs_queued?labelSelector=self-hosted,linux", expected: "2"},
+		{path: "/namespaces/runners/github_actions_jobs_queued?labelSelector=self-hosted%3Dtrue,linux%3Dtrue", expected: "2"},
+		{path: "/namespaces/runners/github_actions_jobs_queued?labelSelector=self-hosted", expected: "0"},
+		{path: "/namespaces/runners/github_actions_jobs_queued", expected: "2"},
+		{path: "/namespaces/default/github_actions_jobs_in_progress?labelSelector=self-hosted,linux,gpu", expected: "1"},
+	} {
+		w := get("/apis/external.metrics.k8s.io/v1beta1" + tt.path)
+		assert.Equal(t, 200, w.Code, tt.path)
+
+		var values externalMetricValueList
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &values))
+		assert.Equal(t, "ExternalMetricValueList", values.Kind)
+		require.Len(t, values.Items, 1)
+		assert.Equal(t, tt.expected, values.Items[0].Value, tt.path)
+	}
+
+	// Unknown metrics and unsupported selectors are rejected with a Status
+	w = get("/apis/external.metrics.k8s.io/v1beta1/namespaces/runners/unknown")
+	assert.Equal(t, 404, w.Code)
+	assert.Contains(t, w.Body.String(), `"reason":"NotFound"`)
+
+	w = get("/apis/external.metrics.k8s.io/v1beta1/namespaces/runners/github_actions_jobs_queued?labelSelector=linux!%3Dtrue")
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), `"kind":"Status"`)
+}
@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExternalMetricsGroupVersion is the Kubernetes API group version served by the external metrics API
+const ExternalMetricsGroupVersion = "external.metrics.k8s.io/v1beta1"
+
+// Names of the metrics served by the external metrics API
+const (
+	ExternalMetricJobsQueued     = "github_actions_jobs_queued"
+	ExternalMetricJobsInProgress = "github_actions_jobs_in_progress"
+)
+
+// apiResource describes a metric in the discovery document of the external metrics API
+type apiResource struct {
+	Name         string   `json:"name"`
+	SingularName string   `json:"singularName"`
+	Namespaced   bool     `json:"namespaced"`
+	Kind         string   `json:"kind"`
+	Verbs        []string `json:"verbs"`
+}
+
+// apiResourceList is the discovery document of the external metrics API
+type apiResourceList struct {
+	Kind         string        `json:"kind"`
+	APIVersion   string        `json:"apiVersion"`
+	GroupVersion string        `json:"groupVersion"`
+	Resources    []apiResource `json:"resources"`
+}
+
+// externalMetricValue is a single value of an external metric
+type externalMetricValue struct {
+	MetricName   string            `json:"metricName"`
+	MetricLabels map[string]string `json:"metricLabels"`
+	Timestamp    string            `json:"timestamp"`
+	Value        string            `json:"value"` // Quantity in the Kubernetes resource format
+}
+
+// externalMetricValueList is the response to an external metric request
+type externalMetricValueList struct {
+	Kind       string                `json:"kind"`
+	APIVersion string                `json:"apiVersion"`
+	Metadata   struct{}              `json:"metadata"`
+	Items      []externalMetricValue `json:"items"`
+}
+
+// apiStatus is the Kubernetes error response
+type apiStatus struct {
+	Kind       string   `json:"kind"`
+	APIVersion string   `json:"apiVersion"`
+	Metadata   struct{} `json:"metadata"`
+	Status     string   `json:"status"`
+	Message    string   `json:"message"`
+	Reason     string   `json:"reason"`
+	Code       int      `json:"code"`
+}
+
+// WithExternalMetricsAPI serves the queued and in progress job counts of the processor as a
+// Kubernetes external metrics API, so that a HorizontalPodAutoscaler can scale runners on them
+// without a Prometheus adapter. The API is registered at /apis/external.metrics.k8s.io/v1beta1.
+func (e *MetricsExposer) WithExternalMetricsAPI(router *gin.Engine, processor *MetricsProcessor) {
+	prefix := "/apis/" + ExternalMetricsGroupVersion
+
+	router.GET(prefix, func(c *gin.Context) {
+		resources := make([]apiResource, 0, 2)
+		for _, name := range []string{ExternalMetricJobsQueued, ExternalMetricJobsInProgress} {
+			resources = append(resources, apiResource{
+				Name:       name,
+				Namespaced: true,
+				Kind:       "ExternalMetricValueList",
+				Verbs:      []string{"get"},
+			})
+		}
+		c.JSON(http.StatusOK, apiResourceList{
+			Kind:         "APIResourceList",
+			APIVersion:   "v1",
+			GroupVersion: ExternalMetricsGroupVersion,
+			Resources:    resources,
+		})
+	})
+
+	// Jobs are not namespaced, every namespace sees the same values
+	router.GET(prefix+"/namespaces/:namespace/:metric", func(c *gin.Context) {
+		metric := c.Param("metric")
+		if metric != ExternalMetricJobsQueued && metric != ExternalMetricJobsInProgress {
+			writeAPIStatus(c, http.StatusNotFound, "NotFound", fmt.Sprintf("external metric %q not found", metric))
+			return
+		}
+
+		labels, err := parseRunnerLabelSelector(c.Query("labelSelector"))
+		if err != nil {
+			writeAPIStatus(c, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+
+		backlog := processor.Backlog(labels)
+		value := backlog.Queued
+		if metric == ExternalMetricJobsInProgress {
+			value = backlog.InProgress
+		}
+
+		metricLabels := map[string]string{}
+		if len(backlog.Labels) > 0 {
+			metricLabels["runner_labels"] = strings.Join(backlog.Labels, ",")
+		}
+		c.JSON(http.StatusOK, externalMetricValueList{
+			Kind:       "ExternalMetricValueList",
+			APIVersion: ExternalMetricsGroupVersion,
+			Items: []externalMetricValue{{
+				MetricName:   metric,
+				MetricLabels: metricLabels,
+				Timestamp:    time.Now().UTC().Format(time.RFC3339),
+				Value:        strconv.Itoa(value),
+			}},
+		})
+	})
+
+	e.logger.Info("External metrics API registered at " + prefix)
+}
+
+// writeAPIStatus responds with a Kubernetes Status error
+func writeAPIStatus(c *gin.Context, code int, reason, message string) {
+	c.JSON(code, apiStatus{
+		Kind:       "Status",
+		APIVersion: "v1",
+		Status:     "Failure",
+		Message:    message,
+		Reason:     reason,
+		Code:       code,
+	})
+}
+
+// parseRunnerLabelSelector reads the runner labels from a Kubernetes label selector. Runner labels
+// are given as label keys, either as existence requirements, e.g. "self-hosted,linux", or with
+// the value "true", as written by matchLabels. Other requirements are rejected.
+func parseRunnerLabelSelector(selector string) ([]string, error) {
+	var labels []string
+	for _, requirement := range strings.Split(selector, ",") {
+		requirement = strings.TrimSpace(requirement)
+		if requirement == "" {
+			continue
+		}
+
+		key, value, hasValue := strings.Cut(requirement, "=")
+		value = strings.TrimPrefix(value, "=")
+		if key == "" || strings.ContainsAny(requirement, "!() ") || (hasValue && value != "true") {
+			return nil, fmt.Errorf("unsupported label selector requirement %q: select runner labels by key or with the value \"true\"", requirement)
+		}
+		labels = append(labels, key)
+	}
+	return labels, nil
+}
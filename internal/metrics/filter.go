@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Constants for the reasons events are dropped before metrics are updated
+const (
+	DropReasonRelabel = "relabel"
+)
+
+// FilterConfig is a pair of allow and deny lists. Patterns are globs, or regular expressions
+// when wrapped in slashes (e.g. "/^ci-.*$/"). Deny takes precedence over allow, and an empty
+// allow list allows everything.
+type FilterConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// FiltersConfig holds the filters evaluated before metrics are updated
+type FiltersConfig struct {
+	Owners       FilterConfig `yaml:"owners"`
+	Repositories FilterConfig `yaml:"repositories"` // Matched against the full name, e.g. "owner/repo"
+	Workflows    FilterConfig `yaml:"workflows"`
+	Events       FilterConfig `yaml:"events"` // Matched against the trigger event, e.g. "push"
+}
+
+// droppedRun records a run dropped by filters or relabel rules, so that its jobs are dropped too
+type droppedRun struct {
+	reason   string
+	lastSeen time.Time // Wall clock time of the last event for this run
+}
+
+// pattern is a compiled glob or regular expression
+type pattern struct {
+	glob  string
+	regex *regexp.Regexp
+}
+
+// matches reports whether the value matches the pattern
+func (p pattern) matches(value string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(value)
+	}
+	matched, _ := path.Match(p.glob, value)
+	return matched
+}
+
+// filterList is a compiled FilterConfig
+type filterList struct {
+	name  string
+	allow []pattern
+	deny  []pattern
+}
+
+// reject returns the reason the value is rejected, or an empty string if it passes
+func (f filterList) reject(value string) string {
+	for _, p := range f.deny {
+		if p.matches(value) {
+			return f.name + "_denied"
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return ""
+	}
+	for _, p := range f.allow {
+		if p.matches(value) {
+			return ""
+		}
+	}
+	return f.name + "_not_allowed"
+}
+
+// eventFilter is a compiled FiltersConfig
+type eventFilter struct {
+	owners       filterList
+	repositories filterList
+	workflows    filterList
+	events       filterList
+}
+
+// compileFilters validates and compiles the filters
+func compileFilters(cfg FiltersConfig) (eventFilter, error) {
+	var filter eventFilter
+	var err error
+
+	if filter.owners, err = compileFilterList("owner", cfg.Owners); err != nil {
+		return filter, err
+	}
+	if filter.repositories, err = compileFilterList("repository", cfg.Repositories); err != nil {
+		return filter, err
+	}
+	if filter.workflows, err = compileFilterList("workflow", cfg.Workflows); err != nil {
+		return filter, err
+	}
+	if filter.events, err = compileFilterList("event", cfg.Events); err != nil {
+		return filter, err
+	}
+
+	return filter, nil
+}
+
+// compileFilterList compiles the patterns of an allow and deny list
+func compileFilterList(name string, cfg FilterConfig) (filterList, error) {
+	list := filterList{name: name}
+	var err error
+
+	if list.allow, err = compilePatterns(cfg.Allow); err != nil {
+		return list, fmt.Errorf("%s allow list: %w", name, err)
+	}
+	if list.deny, err = compilePatterns(cfg.Deny); err != nil {
+		return list, fmt.Errorf("%s deny list: %w", name, err)
+	}
+
+	return list, nil
+}
+
+// compilePatterns compiles glob patterns and slash delimited regular expressions
+func compilePatterns(values []string) ([]pattern, error) {
+	patterns := make([]pattern, 0, len(values))
+	for _, value := range values {
+		if len(value) > 1 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/") {
+			regex, err := regexp.Compile(value[1 : len(value)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %q: %w", value, err)
+			}
+			patterns = append(patterns, pattern{regex: regex})
+			continue
+		}
+
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", value, err)
+		}
+		patterns = append(patterns, pattern{glob: value})
+	}
+
+	return patterns, nil
+}
+
+// reject returns the reason the run is filtered out, or an empty string if it passes
+func (f eventFilter) reject(run WorkflowRun) string {
+	owner, _, _ := strings.Cut(run.Repository, "/")
+
+	if reason := f.owners.reject(owner); reason != "" {
+		return reason
+	}
+	if reason := f.repositories.reject(run.Repository); reason != "" {
+		return reason
+	}
+	if reason := f.workflows.reject(run.Name); reason != "" {
+		return reason
+	}
+
+	// Workflow jobs do not carry the trigger event, jobs of unknown runs only pass the events
+	// filter when it has no allow list
+	if run.Trigger == "" {
+		if len(f.events.allow) > 0 {
+			return f.events.name + "_not_allowed"
+		}
+		return ""
+	}
+	return f.events.reject(run.Trigger)
+}
+
+// dropRun records that the run was dropped for the reason. Must be called with p.mu held.
+func (p *MetricsProcessor) dropRun(run WorkflowRun, reason string) {
+	p.droppedRuns[runKey{id: run.ID, attempt: run.RunAttempt}] = droppedRun{reason: reason, lastSeen: p.now()}
+}
+
+// pruneDroppedRuns forgets dropped runs after the retention period. Must be called with p.mu held.
+func (p *MetricsProcessor) pruneDroppedRuns(now time.Time) {
+	for key, dropped := range p.droppedRuns {
+		if now.Sub(dropped.lastSeen) > runTrackingRetention {
+			delete(p.droppedRuns, key)
+		}
+	}
+}
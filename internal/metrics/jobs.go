@@ -0,0 +1,312 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// WorkflowJob represents a workflow job event
+type WorkflowJob struct {
+	ID              int64
+	RunID           int64 // ID of the workflow run the job belongs to
+	RunAttempt      int
+	Name            string
+	WorkflowName    string
+	Repository      string
+	Branch          string
+	Status          WorkflowRunStatus
+	Conclusion      WorkflowRunConclusion
+	CreatedAt       time.Time
+	StartedAt       time.Time
+	CompletedAt     time.Time
+	Labels          []string // Runner labels requested by the job, e.g. "self-hosted", "linux"
+	RunnerID        int64
+	RunnerName      string // Name of the runner executing the job, empty while queued
+	RunnerGroupName string // Runner group of the runner, "GitHub Actions" for GitHub hosted runners
+	HeadSHA         string
+	HTMLURL         string // Link to the job on GitHub
+	Steps           []WorkflowStep
+}
+
+// jobSeriesKey identifies the label set of the per-job gauges
+type jobSeriesKey struct {
+	repository string
+	workflow   string
+	job        string // Base name of the job, without matrix values
+	matrix     string
+}
+
+// labels returns the label values of the key in the order used by the job metrics, without the
+// matrix dimensions
+func (k jobSeriesKey) labels() []string {
+	return []string{k.repository, k.workflow, k.job, k.matrix}
+}
+
+// nameKey returns the key of the job across its matrix combinations
+func (k jobSeriesKey) nameKey() jobNameKey {
+	return jobNameKey{repository: k.repository, workflow: k.workflow, job: k.job}
+}
+
+// jobSeriesState records what is needed to expire a per-job label set and to order its updates
+type jobSeriesState struct {
+	lastUpdate classUpdates
+	labels     []string // Label values of the series, including the matrix dimensions
+
+	// Latest job reported by the series
+	jobID  int64
+	status WorkflowRunStatus
+}
+
+// isOlder reports whether the job is older than the latest job reported by the series. Re-runs
+// create new jobs, so jobs are ordered by job ID and then by lifecycle status.
+func (s *jobSeriesState) isOlder(job WorkflowJob) bool {
+	if job.ID != s.jobID {
+		return job.ID < s.jobID
+	}
+	return statusRank(job.Status) < statusRank(s.status)
+}
+
+// jobState records the lifecycle of a single job, to account its completion once
+type jobState struct {
+	completed bool
+	queueSeen bool      // Whether the queue time has been observed for this job
+	lastSeen  time.Time // Wall clock time of the last event for this job
+
+	// Backlog of the job while it waits for a runner or executes
+	queued       bool
+	running      bool
+	runnerLabels string // Runner label set the job is queued or in progress for
+	dequeued     bool   // Whether the job left the queue, so late queued events are ignored
+}
+
+// ProcessWorkflowJob processes a workflow job event
+func (p *MetricsProcessor) ProcessWorkflowJob(ctx context.Context, job WorkflowJob) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.prune(p.now())
+
+	run, reason := p.jobRun(job)
+	if reason != "" {
+		p.droppedEvents.WithLabelValues(reason).Inc()
+		p.logger.Debug("Workflow job dropped",
+			zap.Int64("jobID", job.ID),
+			zap.Int64("runID", job.RunID),
+			zap.String("repository", job.Repository),
+			zap.String("reason", reason))
+		return nil
+	}
+
+	key, labels := p.jobIdentity(run, job)
+	if p.touchJobSeries(key, labels, run, job) {
+		p.workflowJobStatus.WithLabelValues(labels...).Set(statusValue(job.Status, job.Conclusion))
+	} else {
+		p.staleEvents.WithLabelValues(key.repository).Inc()
+		p.logger.Debug("Ignoring out of order workflow job event",
+			zap.Int64("jobID", job.ID),
+			zap.String("status", string(job.Status)))
+	}
+
+	exemplar := runExemplar(WorkflowRun{ID: job.RunID, HTMLURL: job.HTMLURL})
+	state, completed := p.trackJob(job)
+	p.trackApproval(run, job)
+	p.observeJobQueueTime(run, job, state, exemplar)
+	p.trackBacklog(job, state)
+	p.trackRunner(job, state, completed)
+
+	// Account completed jobs once, even when GitHub delivers the completion more than once
+	if completed {
+		labels = append(labels, string(job.Conclusion))
+		incWithExemplar(p.workflowJobsTotal.WithLabelValues(labels...), exemplar)
+		if !job.StartedAt.IsZero() && !job.CompletedAt.Before(job.StartedAt) {
+			observeWithExemplar(p.workflowJobDuration.WithLabelValues(labels...), job.CompletedAt.Sub(job.StartedAt).Seconds(), exemplar)
+		}
+		p.observeSteps(key, job, exemplar)
+		p.accountBilling(key, job)
+	}
+
+	return nil
+}
+
+// jobRun returns the run a job belongs to, or the reason the job is dropped. Jobs of runs seen
+// before share the repository and workflow labels of their run, and jobs of dropped runs are
+// dropped for the same reason. Otherwise the job is filtered and relabeled by itself; job
+// payloads do not carry the trigger event, the workflow ID or the workflow path, so the job is
+// rejected when the events filter has an allow list and the workflow label is the name.
+// Must be called with p.mu held.
+func (p *MetricsProcessor) jobRun(job WorkflowJob) (WorkflowRun, string) {
+	run := WorkflowRun{
+		ID:         job.RunID,
+		Name:       job.WorkflowName,
+		Repository: job.Repository,
+		RunAttempt: job.RunAttempt,
+		Branch:     job.Branch,
+		HeadSHA:    job.HeadSHA,
+	}
+
+	key := runKey{id: job.RunID, attempt: job.RunAttempt}
+	if phases, ok := p.runPhases[key]; ok {
+		run.Repository = phases.repository
+		run.Name = phases.workflow
+		run.branchClass = phases.class
+		return run, ""
+	}
+	if dropped, ok := p.droppedRuns[key]; ok {
+		return run, dropped.reason
+	}
+
+	if reason := p.filter.reject(run); reason != "" {
+		return run, reason
+	}
+
+	run, keep := relabel(p.relabel, run)
+	if !keep {
+		return run, DropReasonRelabel
+	}
+	return run, ""
+}
+
+// touchJobSeries records an update of a per-job label set by a job of the run. It reports false
+// when the job is older than the latest job of the series. Must be called with p.mu held.
+func (p *MetricsProcessor) touchJobSeries(key jobSeriesKey, labels []string, run WorkflowRun, job WorkflowJob) bool {
+	state, ok := p.jobSeries[key]
+	if !ok {
+		state = &jobSeriesState{lastUpdate: make(classUpdates), labels: labels}
+		p.jobSeries[key] = state
+	}
+	state.lastUpdate[run.BranchClass()] = p.now()
+	if state.isOlder(job) {
+		return false
+	}
+
+	state.jobID = job.ID
+	state.status = job.Status
+	return true
+}
+
+// trackJob records the job and reports whether this event is the first completion seen for it.
+// Must be called with p.mu held.
+func (p *MetricsProcessor) trackJob(job WorkflowJob) (*jobState, bool) {
+	state, ok := p.jobs[job.ID]
+	if !ok {
+		state = &jobState{}
+		p.jobs[job.ID] = state
+	}
+	state.lastSeen = p.now()
+
+	if job.Status != WorkflowRunStatusCompleted || state.completed {
+		return state, false
+	}
+	state.completed = true
+	return state, true
+}
+
+// observeJobQueueTime records the time a job of the run waited for a runner, once per job. Queued
+// deliveries already carry a start time, so only jobs that were picked up by a runner are
+// observed. Jobs that waited on their environment wait for a runner from the end of that wait.
+// Must be called with p.mu held.
+func (p *MetricsProcessor) observeJobQueueTime(run WorkflowRun, job WorkflowJob, state *jobState, exemplar prometheus.Labels) {
+	switch job.Status {
+	case WorkflowRunStatusInProgress:
+	case WorkflowRunStatusCompleted:
+		// Jobs skipped or cancelled before they started never waited for a runner
+		if job.Conclusion == WorkflowRunConclusionSkipped || job.Conclusion == WorkflowRunConclusionCancelled {
+			return
+		}
+	default:
+		return
+	}
+
+	if state.queueSeen {
+		return
+	}
+	queuedAt := job.CreatedAt
+	if approval, ok := p.approvals[job.ID]; ok && approval.done {
+		// Jobs that were not approved never waited for a runner
+		if approval.outcome != DeploymentReviewApproved {
+			return
+		}
+		if approval.until.After(queuedAt) {
+			queuedAt = approval.until
+		}
+	}
+	if queuedAt.IsZero() || job.StartedAt.IsZero() || job.StartedAt.Before(queuedAt) {
+		p.logger.Debug("Skipping queue time for workflow job without valid timestamps",
+			zap.Int64("jobID", job.ID))
+		return
+	}
+
+	state.queueSeen = true
+	labels := runnerLabels(job.Labels)
+	if _, ok := p.jobQueueSeries[labels]; !ok {
+		p.jobQueueSeries[labels] = make(classUpdates)
+	}
+	p.jobQueueSeries[labels][run.BranchClass()] = p.now()
+	observeWithExemplar(p.workflowJobQueue.WithLabelValues(labels), job.StartedAt.Sub(queuedAt).Seconds(), exemplar)
+}
+
+// pruneJobs expires the per-job and queue time label sets that no run updated within the TTL of
+// its branch class, and forgets jobs after the retention period. Must be called with p.mu held.
+func (p *MetricsProcessor) pruneJobs(now time.Time) {
+	for id, state := range p.jobs {
+		if now.Sub(state.lastSeen) > runTrackingRetention {
+			p.dequeueJob(state)
+			p.finishJob(state)
+			delete(p.jobs, id)
+		}
+	}
+
+	for key, state := range p.jobSeries {
+		class, expired := state.lastUpdate.expired(p.cfg, now)
+		if !expired {
+			continue
+		}
+
+		p.deleteJobSeries(key)
+		p.evictedSeries.WithLabelValues(string(class)).Inc()
+		p.logger.Debug("Evicted stale workflow job series",
+			zap.String("repository", key.repository),
+			zap.String("workflow", key.workflow),
+			zap.String("job", key.job),
+			zap.String("matrix", key.matrix))
+	}
+
+	for labels, lastUpdate := range p.jobQueueSeries {
+		class, expired := lastUpdate.expired(p.cfg, now)
+		if !expired {
+			continue
+		}
+
+		p.workflowJobQueue.DeleteLabelValues(labels)
+		delete(p.jobQueueSeries, labels)
+		p.evictedSeries.WithLabelValues(string(class)).Inc()
+	}
+}
+
+// deleteJobSeries removes a per-job label set from the job status, count and duration metrics,
+// for every conclusion, and frees its matrix combination. Must be called with p.mu held.
+func (p *MetricsProcessor) deleteJobSeries(key jobSeriesKey) {
+	if state, ok := p.jobNames[key.nameKey()]; ok {
+		delete(state.combinations, key.matrix)
+	}
+
+	state := p.jobSeries[key]
+	p.workflowJobStatus.DeleteLabelValues(state.labels...)
+
+	labels := make(prometheus.Labels, len(state.labels))
+	for i, name := range jobLabelNames(p.matrixDimensions) {
+		labels[name] = state.labels[i]
+	}
+	p.workflowJobsTotal.DeletePartialMatch(labels)
+	p.workflowJobDuration.DeletePartialMatch(labels)
+	delete(p.jobSeries, key)
+}
+
+// jobLabelNames returns the label names of the per-job metrics with the matrix dimensions, without
+// the conclusion
+func jobLabelNames(dimensions []string) []string {
+	return append([]string{"repository", "workflow", "job", "matrix"}, dimensions...)
+}
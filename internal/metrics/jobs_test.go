@@ -0,0 +1,741 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestWorkflowJobMetrics(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry)
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	process := func(id int64, name string, status WorkflowRunStatus, conclusion WorkflowRunConclusion, duration time.Duration) {
+		job := WorkflowJob{
+			ID:           id,
+			RunID:        100,
+			RunAttempt:   1,
+			Name:         name,
+			WorkflowName: "CI",
+			Repository:   "myorg/myrepo",
+			Branch:       "main",
+			Status:       status,
+			Conclusion:   conclusion,
+			CreatedAt:    start,
+		}
+		if status != WorkflowRunStatusQueued {
+			job.StartedAt = start
+		}
+		if status == WorkflowRunStatusCompleted {
+			job.CompletedAt = start.Add(duration)
+		}
+		require.NoError(t, processor.ProcessWorkflowJob(context.Background(), job))
+	}
+
+	process(1, "build", WorkflowRunStatusQueued, "", 0)
+	process(2, "test", WorkflowRunStatusQueued, "", 0)
+	process(1, "build", WorkflowRunStatusInProgress, "", 0)
+	assert.Equal(t, 9.0, testutil.ToFloat64(processor.workflowJobStatus.WithLabelValues("myorg/myrepo", "CI", "build", "")))
+
+	process(1, "build", WorkflowRunStatusCompleted, WorkflowRunConclusionSuccess, 2*time.Minute)
+	process(2, "test", WorkflowRunStatusCompleted, WorkflowRunConclusionFailure, 5*time.Minute)
+
+	// Repeated and late deliveries are not counted again and do not move the gauge back
+	process(2, "test", WorkflowRunStatusCompleted, WorkflowRunConclusionFailure, 5*time.Minute)
+	process(2, "test", WorkflowRunStatusInProgress, "", 0)
+
+	assert.Equal(t, 10.0, testutil.ToFloat64(processor.workflowJobStatus.WithLabelValues("myorg/myrepo", "CI", "build", "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.workflowJobStatus.WithLabelValues("myorg/myrepo", "CI", "test", "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.workflowJobsTotal.WithLabelValues("myorg/myrepo", "CI", "build", "", "success")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.workflowJobsTotal.WithLabelValues("myorg/myrepo", "CI", "test", "", "failure")))
+	assertHistogram(t, processor.workflowJobDuration.WithLabelValues("myorg/myrepo", "CI", "test", "", "failure"), 1, 300)
+
+	// A re-run of the job creates a new job that replaces the status
+	process(3, "test", WorkflowRunStatusCompleted, WorkflowRunConclusionSuccess, 4*time.Minute)
+	assert.Equal(t, 10.0, testutil.ToFloat64(processor.workflowJobStatus.WithLabelValues("myorg/myrepo", "CI", "test", "")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.staleEvents.WithLabelValues("myorg/myrepo")))
+}
+
+func TestWorkflowJobLabelsFollowRun(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry,
+		WithWorkflowLabel(WorkflowLabelPath),
+		WithFilters(FiltersConfig{
+			Repositories: FilterConfig{Deny: []string{"myorg/sandbox"}},
+			Events:       FilterConfig{Deny: []string{"schedule"}},
+		}))
+
+	for runID, trigger := range map[int64]string{100: "push", 400: "schedule"} {
+		err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+			ID:           runID,
+			Name:         "CI",
+			WorkflowPath: ".github/workflows/ci.yml",
+			Repository:   "myorg/myrepo",
+			Status:       WorkflowRunStatusInProgress,
+			RunAttempt:   1,
+			Branch:       "main",
+			Trigger:      trigger,
+			RefType:      "branch",
+		})
+		require.NoError(t, err)
+	}
+
+	process := func(processor *MetricsProcessor, id, runID int64, repository string) {
+		err := processor.ProcessWorkflowJob(context.Background(), WorkflowJob{
+			ID:           id,
+			RunID:        runID,
+			RunAttempt:   1,
+			Name:         "build",
+			WorkflowName: "CI",
+			Repository:   repository,
+			Status:       WorkflowRunStatusCompleted,
+			Conclusion:   WorkflowRunConclusionSuccess,
+		})
+		require.NoError(t, err)
+	}
+
+	// Jobs of a known run use the workflow label of the run
+	process(processor, 1, 100, "myorg/myrepo")
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.workflowJobsTotal.WithLabelValues("myorg/myrepo", ".github/workflows/ci.yml", "build", "", "success")))
+
+	// Jobs of unknown runs are filtered by themselves and fall back to the workflow name
+	process(processor, 2, 200, "myorg/other")
+	process(processor, 3, 300, "myorg/sandbox")
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.workflowJobsTotal.WithLabelValues("myorg/other", "CI", "build", "", "success")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.droppedEvents.WithLabelValues("repository_denied")))
+
+	// Jobs of dropped runs are dropped for the same reason
+	process(processor, 4, 400, "myorg/myrepo")
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.droppedEvents.WithLabelValues("event_denied")))
+	assert.Equal(t, 2, testutil.CollectAndCount(processor.workflowJobsTotal))
+
+	// With an events allow list, jobs of unknown runs are rejected
+	processor = NewMetricsProcessor(logger, prometheus.NewRegistry(), WithFilters(FiltersConfig{
+		Events: FilterConfig{Allow: []string{"push"}},
+	}))
+	process(processor, 5, 500, "myorg/myrepo")
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.droppedEvents.WithLabelValues("event_not_allowed")))
+	assert.Equal(t, 0, testutil.CollectAndCount(processor.workflowJobsTotal))
+}
+
+func TestWorkflowJobSeriesTTL(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithSeriesTTL(time.Hour, map[BranchClass]time.Duration{
+		BranchClassDefault: 0,
+	}))
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	processor.now = func() time.Time { return now }
+
+	for i, job := range []struct{ name, branch, runner string }{
+		{"build", "main", "ubuntu-latest"},
+		{"lint", "feature/ttl", "self-hosted"},
+	} {
+		err := processor.ProcessWorkflowJob(context.Background(), WorkflowJob{
+			ID:           int64(i + 1),
+			RunID:        100,
+			Name:         job.name,
+			WorkflowName: "CI",
+			Repository:   "myorg/myrepo",
+			Branch:       job.branch,
+			Status:       WorkflowRunStatusCompleted,
+			Conclusion:   WorkflowRunConclusionSuccess,
+			CreatedAt:    now.Add(-3 * time.Minute),
+			StartedAt:    now.Add(-2 * time.Minute),
+			CompletedAt:  now,
+			Labels:       []string{job.runner},
+		})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, testutil.CollectAndCount(processor.workflowJobStatus))
+	assert.Equal(t, 2, testutil.CollectAndCount(processor.workflowJobsTotal))
+	assert.Equal(t, 2, testutil.CollectAndCount(processor.workflowJobDuration))
+	assert.Equal(t, 2, testutil.CollectAndCount(processor.workflowJobQueue))
+
+	// After the TTL the feature branch series are evicted, the default branch is kept forever
+	now = now.Add(2 * time.Hour)
+	processor.prune(now)
+	assert.Equal(t, 1, testutil.CollectAndCount(processor.workflowJobStatus))
+	assert.Equal(t, 1, testutil.CollectAndCount(processor.workflowJobsTotal))
+	assert.Equal(t, 1, testutil.CollectAndCount(processor.workflowJobDuration))
+	assert.Equal(t, 1, testutil.CollectAndCount(processor.workflowJobQueue))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.workflowJobsTotal.WithLabelValues("myorg/myrepo", "CI", "build", "", "success")))
+	assert.Len(t, processor.jobSeries, 1)
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.evictedSeries.WithLabelValues("feature")))
+}
+
+func TestWorkflowJobQueueTime(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry)
+
+	created := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	process := func(id int64, labels []string, status WorkflowRunStatus, conclusion WorkflowRunConclusion, wait time.Duration) {
+		err := processor.ProcessWorkflowJob(context.Background(), WorkflowJob{
+			ID:           id,
+			RunID:        100,
+			Name:         "build",
+			WorkflowName: "CI",
+			Repository:   "myorg/myrepo",
+			Status:       status,
+			Conclusion:   conclusion,
+			CreatedAt:    created,
+			StartedAt:    created.Add(wait),
+			Labels:       labels,
+		})
+		require.NoError(t, err)
+	}
+
+	gpu := []string{"self-hosted", "Linux", "x64", "gpu"}
+
+	// Queued deliveries carry a start time, but the job has not been picked up yet
+	process(1, gpu, WorkflowRunStatusQueued, "", 0)
+	assert.Equal(t, 0, testutil.CollectAndCount(processor.workflowJobQueue))
+
+	// Each job is observed once, whichever of its deliveries carries the start first
+	process(1, gpu, WorkflowRunStatusInProgress, "", 10*time.Minute)
+	process(1, gpu, WorkflowRunStatusCompleted, WorkflowRunConclusionSuccess, 10*time.Minute)
+	process(2, []string{"gpu", "linux", "self-hosted", "X64", "x64"}, WorkflowRunStatusCompleted, WorkflowRunConclusionFailure, 20*time.Minute)
+	process(3, []string{"ubuntu-latest"}, WorkflowRunStatusInProgress, "", 5*time.Second)
+
+	// Jobs cancelled while queued never waited for a runner
+	process(4, []string{"ubuntu-latest"}, WorkflowRunStatusCompleted, WorkflowRunConclusionCancelled, time.Hour)
+
+	assertHistogram(t, processor.workflowJobQueue.WithLabelValues("gpu,linux,self-hosted,x64"), 2, 1800)
+	assertHistogram(t, processor.workflowJobQueue.WithLabelValues("ubuntu-latest"), 1, 5)
+}
+
+func TestRunnerLabels(t *testing.T) {
+	tests := []struct {
+		labels   []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"ubuntu-latest"}, "ubuntu-latest"},
+		{[]string{"self-hosted", "linux", "x64", "gpu"}, "gpu,linux,self-hosted,x64"},
+		{[]string{"Self-Hosted", " linux ", "linux", ""}, "linux,self-hosted"},
+		{[]string{"ubuntu-22.04-16core"}, "ubuntu-22.04-16core"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, runnerLabels(tt.labels), "labels %v", tt.labels)
+	}
+}
+
+func TestRunnerUtilization(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithRunTimeout(time.Hour), WithRunnerTTL(6*time.Hour))
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	processor.now = func() time.Time { return now }
+
+	process := func(id int64, labels []string, group, runner string, status WorkflowRunStatus, duration time.Duration) {
+		job := WorkflowJob{
+			ID:              id,
+			RunID:           100,
+			Name:            "build",
+			WorkflowName:    "CI",
+			Repository:      "myorg/myrepo",
+			Status:          status,
+			Labels:          labels,
+			RunnerName:      runner,
+			RunnerGroupName: group,
+			StartedAt:       now,
+		}
+		if status == WorkflowRunStatusCompleted {
+			job.Conclusion = WorkflowRunConclusionSuccess
+			job.CompletedAt = now.Add(duration)
+		}
+		require.NoError(t, processor.ProcessWorkflowJob(context.Background(), job))
+	}
+
+	gpu := []string{"self-hosted", "linux", "gpu"}
+	hosted := []string{"ubuntu-latest"}
+
+	process(1, gpu, "gpu-pool", "gpu-1", WorkflowRunStatusQueued, 0)
+	process(1, gpu, "gpu-pool", "gpu-1", WorkflowRunStatusInProgress, 0)
+	process(2, gpu, "gpu-pool", "gpu-2", WorkflowRunStatusInProgress, 0)
+	process(3, hosted, "GitHub Actions", "GitHub Actions 7", WorkflowRunStatusInProgress, 0)
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.runnersBusy.WithLabelValues("gpu-pool", "self_hosted")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.runnersBusy.WithLabelValues("GitHub Actions", "github_hosted")))
+
+	// Completions release the runners, late deliveries do not mark them busy again
+	process(1, gpu, "gpu-pool", "gpu-1", WorkflowRunStatusCompleted, 10*time.Minute)
+	process(1, gpu, "gpu-pool", "gpu-1", WorkflowRunStatusCompleted, 10*time.Minute)
+	process(1, gpu, "gpu-pool", "gpu-1", WorkflowRunStatusInProgress, 0)
+	process(3, hosted, "GitHub Actions", "GitHub Actions 7", WorkflowRunStatusCompleted, 2*time.Minute)
+	process(4, gpu, "gpu-pool", "gpu-1", WorkflowRunStatusCompleted, 5*time.Minute)
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.runnersBusy.WithLabelValues("gpu-pool", "self_hosted")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(processor.runnersBusy.WithLabelValues("GitHub Actions", "github_hosted")))
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.runnerGroupJobs.WithLabelValues("gpu-pool", "self_hosted")))
+	assert.Equal(t, 900.0, testutil.ToFloat64(processor.runnerGroupBusySeconds.WithLabelValues("gpu-pool", "self_hosted")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.runnerGroupJobs.WithLabelValues("GitHub Actions", "github_hosted")))
+	assert.Equal(t, 120.0, testutil.ToFloat64(processor.runnerGroupBusySeconds.WithLabelValues("GitHub Actions", "github_hosted")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.runnerJobs.WithLabelValues("gpu-pool", "gpu-1")))
+	assert.Equal(t, 900.0, testutil.ToFloat64(processor.runnerBusySeconds.WithLabelValues("gpu-pool", "gpu-1")))
+
+	// Runner scale sets are self-hosted without the self-hosted label
+	process(5, []string{"arc-runner-set"}, "Default", "arc-runner-set-x7k2p", WorkflowRunStatusCompleted, 3*time.Minute)
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.runnerGroupJobs.WithLabelValues("Default", "self_hosted")))
+	assert.Equal(t, 180.0, testutil.ToFloat64(processor.runnerBusySeconds.WithLabelValues("Default", "arc-runner-set-x7k2p")))
+
+	// GitHub hosted runners are single use and not accounted individually
+	assert.Equal(t, 2, testutil.CollectAndCount(processor.runnerJobs))
+
+	// Runners whose job never completes are released after the run timeout, and the
+	// counters of runners that stopped running jobs expire after the runner TTL, even
+	// though series do not expire by default
+	now = now.Add(2 * time.Hour)
+	processor.prune(now)
+	assert.Equal(t, 0.0, testutil.ToFloat64(processor.runnersBusy.WithLabelValues("gpu-pool", "self_hosted")))
+	assert.Equal(t, 2, testutil.CollectAndCount(processor.runnerJobs))
+
+	now = now.Add(6 * time.Hour)
+	processor.prune(now)
+	assert.Equal(t, 0, testutil.CollectAndCount(processor.runnerJobs))
+	assert.Equal(t, 0, testutil.CollectAndCount(processor.runnerBusySeconds))
+}
+
+func TestJobBacklog(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithRunTimeout(time.Hour))
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	processor.now = func() time.Time { return now }
+
+	process := func(id int64, labels []string, status WorkflowRunStatus) {
+		job := WorkflowJob{
+			ID:           id,
+			RunID:        100,
+			Name:         "build",
+			WorkflowName: "CI",
+			Repository:   "myorg/myrepo",
+			Status:       status,
+			Labels:       labels,
+		}
+		if status == WorkflowRunStatusCompleted {
+			job.Conclusion = WorkflowRunConclusionCancelled
+		}
+		require.NoError(t, processor.ProcessWorkflowJob(context.Background(), job))
+	}
+
+	gpu := []string{"self-hosted", "Linux", "gpu"}
+	linux := []string{"self-hosted", "linux"}
+
+	process(1, gpu, WorkflowRunStatusQueued)
+	process(1, gpu, WorkflowRunStatusQueued)
+	process(2, linux, WorkflowRunStatusQueued)
+	process(3, linux, WorkflowRunStatusQueued)
+	process(4, []string{"ubuntu-latest"}, WorkflowRunStatusQueued)
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.jobsQueued.WithLabelValues("gpu,linux,self-hosted")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.jobsQueued.WithLabelValues("linux,self-hosted")))
+
+	// Started and cancelled jobs leave the backlog, late queued events do not queue them again
+	process(2, linux, WorkflowRunStatusInProgress)
+	process(2, linux, WorkflowRunStatusQueued)
+	process(3, linux, WorkflowRunStatusCompleted)
+	assert.Equal(t, 0.0, testutil.ToFloat64(processor.jobsQueued.WithLabelValues("linux,self-hosted")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.jobsInProgress.WithLabelValues("linux,self-hosted")))
+
+	process(5, linux, WorkflowRunStatusQueued)
+	assert.Equal(t, Backlog{
+		Labels:     []string{"gpu", "linux", "self-hosted"},
+		Queued:     2,
+		InProgress: 1,
+		LabelSets: []BacklogLabelSet{
+			{Labels: "gpu,linux,self-hosted", Queued: 1},
+			{Labels: "linux,self-hosted", Queued: 1, InProgress: 1},
+		},
+	}, processor.Backlog([]string{"Self-Hosted", "linux", "gpu"}))
+	assert.Equal(t, 1, processor.Backlog([]string{"self-hosted", "linux"}).Queued)
+	assert.Equal(t, 3, processor.Backlog(nil).Queued)
+
+	// Jobs whose next event is lost are removed after the run timeout
+	now = now.Add(2 * time.Hour)
+	processor.prune(now)
+	assert.Equal(t, 0.0, testutil.ToFloat64(processor.jobsQueued.WithLabelValues("gpu,linux,self-hosted")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(processor.jobsInProgress.WithLabelValues("linux,self-hosted")))
+	assert.Equal(t, Backlog{LabelSets: []BacklogLabelSet{}}, processor.Backlog(nil))
+}
+
+func TestWorkflowJobApprovals(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithRunTimeout(time.Hour))
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	processor.now = func() time.Time { return now }
+
+	created := now
+	processRun := func(id, runID int64, status WorkflowRunStatus, conclusion WorkflowRunConclusion, startedAt time.Time) {
+		require.NoError(t, processor.ProcessWorkflowJob(context.Background(), WorkflowJob{
+			ID:           id,
+			RunID:        runID,
+			Name:         "deploy",
+			WorkflowName: "CD",
+			Repository:   "myorg/myrepo",
+			Status:       status,
+			Conclusion:   conclusion,
+			CreatedAt:    created,
+			StartedAt:    startedAt,
+			CompletedAt:  now,
+		}))
+	}
+	process := func(id int64, status WorkflowRunStatus, conclusion WorkflowRunConclusion) {
+		processRun(id, 100, status, conclusion, now)
+	}
+	protectionRule := func(runID int64, environment string) {
+		require.NoError(t, processor.ProcessDeploymentProtectionRule(context.Background(), DeploymentProtectionRule{
+			Repository:  "myorg/myrepo",
+			Environment: environment,
+			RunID:       runID,
+		}))
+	}
+	review := func(action DeploymentReviewAction, environment string, ids ...int64) {
+		var jobs []DeploymentReviewJob
+		for _, id := range ids {
+			jobs = append(jobs, DeploymentReviewJob{ID: id, Environment: environment})
+		}
+		require.NoError(t, processor.ProcessDeploymentReview(context.Background(), DeploymentReview{
+			Action:       action,
+			Repository:   "myorg/myrepo",
+			Environment:  environment,
+			RunID:        100,
+			WorkflowName: "CD",
+			Jobs:         jobs,
+		}))
+	}
+	waiting := func(environment string) float64 {
+		return testutil.ToFloat64(processor.workflowJobsWaiting.WithLabelValues("myorg/myrepo", environment))
+	}
+
+	// Waiting jobs are counted by environment once a review or protection rule names it
+	process(1, WorkflowRunStatusWaiting, "")
+	process(2, WorkflowRunStatusWaiting, "")
+	processRun(3, 300, WorkflowRunStatusWaiting, "", time.Time{})
+	processRun(4, 400, WorkflowRunStatusWaiting, "", time.Time{})
+	processRun(7, 400, WorkflowRunStatusWaiting, "", time.Time{})
+	assert.Equal(t, 5.0, waiting(""))
+
+	review(DeploymentReviewRequested, "production", 1, 2)
+	protectionRule(300, "staging")
+	assert.Equal(t, 2.0, waiting("production"))
+	assert.Equal(t, 1.0, waiting("staging"))
+
+	// The protection rule does not name its job, the environment stays unknown when several
+	// jobs of the run are waiting
+	protectionRule(400, "staging")
+	assert.Equal(t, 1.0, waiting("staging"))
+	assert.Equal(t, 2.0, waiting(""))
+
+	// Reviews end the wait once, the following job events do not observe it again
+	now = now.Add(30 * time.Minute)
+	review(DeploymentReviewApproved, "production", 1)
+	review(DeploymentReviewApproved, "production", 1)
+	process(1, WorkflowRunStatusQueued, "")
+	review(DeploymentReviewRejected, "production", 2)
+	process(2, WorkflowRunStatusCompleted, WorkflowRunConclusionFailure)
+	assert.Equal(t, 0.0, waiting("production"))
+	assertHistogram(t, processor.workflowJobApprovalWait.WithLabelValues("myorg/myrepo", "production", "approved"), 1, 1800)
+	assertHistogram(t, processor.workflowJobApprovalWait.WithLabelValues("myorg/myrepo", "production", "rejected"), 1, 1800)
+
+	// Jobs released by a protection rule are approved when they are queued, cancelled jobs are not observed
+	now = now.Add(30 * time.Minute)
+	processRun(3, 300, WorkflowRunStatusQueued, "", created)
+	processRun(4, 400, WorkflowRunStatusCompleted, WorkflowRunConclusionCancelled, time.Time{})
+	assert.Equal(t, 0.0, waiting("staging"))
+	assertHistogram(t, processor.workflowJobApprovalWait.WithLabelValues("myorg/myrepo", "staging", "approved"), 1, 3600)
+
+	// Queued deliveries carry the creation time as their start time: the wait ends with the queued
+	// event and the job waits for a runner from there, not from its creation
+	processRun(7, 400, WorkflowRunStatusQueued, "", created)
+	assert.Equal(t, 0.0, waiting(""))
+	assertHistogram(t, processor.workflowJobApprovalWait.WithLabelValues("myorg/myrepo", "", "approved"), 1, 3600)
+	assert.Equal(t, 4, testutil.CollectAndCount(processor.workflowJobApprovalWait))
+
+	now = now.Add(2 * time.Hour)
+	processRun(7, 400, WorkflowRunStatusInProgress, "", now)
+	assertHistogram(t, processor.workflowJobQueue.WithLabelValues(""), 1, 7200)
+
+	// Jobs that started waiting before the exporter are observed from the review
+	require.NoError(t, processor.ProcessDeploymentReview(context.Background(), DeploymentReview{
+		Action:      DeploymentReviewApproved,
+		Repository:  "myorg/myrepo",
+		Environment: "production",
+		RunID:       200,
+		Since:       now.Add(-10 * time.Minute),
+		Jobs:        []DeploymentReviewJob{{ID: 5}},
+	}))
+	assertHistogram(t, processor.workflowJobApprovalWait.WithLabelValues("myorg/myrepo", "production", "approved"), 2, 2400)
+
+	// Jobs whose review is lost stop waiting after the run timeout
+	process(6, WorkflowRunStatusWaiting, "")
+	now = now.Add(2 * time.Hour)
+	processor.prune(now)
+	assert.Equal(t, 0.0, waiting(""))
+}
+
+func TestWorkflowJobRunnerType(t *testing.T) {
+	assert.Equal(t, RunnerTypeSelfHosted, WorkflowJob{Labels: []string{"Self-Hosted", "linux"}}.RunnerType())
+	assert.Equal(t, RunnerTypeGitHubHosted, WorkflowJob{Labels: []string{"ubuntu-latest"}}.RunnerType())
+	assert.Equal(t, RunnerTypeGitHubHosted, WorkflowJob{Labels: []string{"ubuntu-latest"}, RunnerGroupName: GitHubHostedRunnerGroup}.RunnerType())
+	assert.Equal(t, RunnerTypeSelfHosted, WorkflowJob{Labels: []string{"arc-runner-set"}, RunnerGroupName: "Default"}.RunnerType())
+	assert.Equal(t, RunnerTypeGitHubHosted, WorkflowJob{}.RunnerType())
+}
+
+func TestWorkflowStepMetrics(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithMaxStepsPerJob(4), WithSeriesTTL(time.Hour, nil))
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	processor.now = func() time.Time { return now }
+	step := func(name string, conclusion WorkflowRunConclusion, offset, duration time.Duration) WorkflowStep {
+		return WorkflowStep{
+			Name:        name,
+			Status:      WorkflowRunStatusCompleted,
+			Conclusion:  conclusion,
+			StartedAt:   start.Add(offset),
+			CompletedAt: start.Add(offset + duration),
+		}
+	}
+	process := func(id int64, status WorkflowRunStatus, conclusion WorkflowRunConclusion, steps ...WorkflowStep) {
+		err := processor.ProcessWorkflowJob(context.Background(), WorkflowJob{
+			ID:           id,
+			RunID:        100,
+			Name:         "deploy",
+			WorkflowName: "Deploy",
+			Repository:   "myorg/myrepo",
+			Status:       status,
+			Conclusion:   conclusion,
+			Steps:        steps,
+		})
+		require.NoError(t, err)
+	}
+
+	// Steps are only observed once the job completed, and only once
+	process(1, WorkflowRunStatusInProgress, "", step("Set up job", WorkflowRunConclusionSuccess, 0, time.Second))
+	assert.Equal(t, 0, testutil.CollectAndCount(processor.workflowStepDuration))
+
+	steps := []WorkflowStep{
+		step("Set up job", WorkflowRunConclusionSuccess, 0, 2*time.Second),
+		step("npm ci", WorkflowRunConclusionSuccess, 2*time.Second, 40*time.Second),
+		step("Deploy", WorkflowRunConclusionFailure, 42*time.Second, 10*time.Second),
+		step("Notify", WorkflowRunConclusionSkipped, 52*time.Second, 0),
+	}
+	process(1, WorkflowRunStatusCompleted, WorkflowRunConclusionFailure, steps...)
+	process(1, WorkflowRunStatusCompleted, WorkflowRunConclusionFailure, steps...)
+
+	assertHistogram(t, processor.workflowStepDuration.WithLabelValues("myorg/myrepo", "Deploy", "deploy", "npm ci"), 1, 40)
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.workflowStepFailures.WithLabelValues("myorg/myrepo", "Deploy", "deploy", "Deploy")))
+	assert.Equal(t, 3, testutil.CollectAndCount(processor.workflowStepDuration))
+	assert.Equal(t, 1, testutil.CollectAndCount(processor.workflowStepFailures))
+
+	// Step observations link to the run of their job
+	metric := &dto.Metric{}
+	require.NoError(t, processor.workflowStepFailures.WithLabelValues("myorg/myrepo", "Deploy", "deploy", "Deploy").(prometheus.Metric).Write(metric))
+	require.NotNil(t, metric.GetCounter().GetExemplar())
+	assert.Equal(t, "run_id", metric.GetCounter().GetExemplar().GetLabel()[0].GetName())
+	assert.Equal(t, "100", metric.GetCounter().GetExemplar().GetLabel()[0].GetValue())
+
+	// New step names beyond the limit are folded into the overflow step, which takes the last slot
+	process(2, WorkflowRunStatusCompleted, WorkflowRunConclusionFailure,
+		step("npm ci", WorkflowRunConclusionSuccess, 0, 20*time.Second),
+		step("Smoke test", WorkflowRunConclusionFailure, 20*time.Second, 5*time.Second),
+		step("Rollback", WorkflowRunConclusionSuccess, 25*time.Second, 5*time.Second),
+	)
+	assertHistogram(t, processor.workflowStepDuration.WithLabelValues("myorg/myrepo", "Deploy", "deploy", "npm ci"), 2, 60)
+	assertHistogram(t, processor.workflowStepDuration.WithLabelValues("myorg/myrepo", "Deploy", "deploy", OverflowStep), 2, 10)
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.workflowStepFailures.WithLabelValues("myorg/myrepo", "Deploy", "deploy", OverflowStep)))
+	assert.Equal(t, 4, testutil.CollectAndCount(processor.workflowStepDuration))
+
+	// Once the series of the job expire, its step series are deleted with the step names
+	now = now.Add(2 * time.Hour)
+	processor.prune(now)
+	assert.Equal(t, 0, testutil.CollectAndCount(processor.workflowStepDuration))
+	assert.Equal(t, 0, testutil.CollectAndCount(processor.workflowStepFailures))
+	assert.Empty(t, processor.jobNames)
+
+	process(3, WorkflowRunStatusCompleted, WorkflowRunConclusionSuccess, step("Smoke test", WorkflowRunConclusionSuccess, 0, 5*time.Second))
+	assertHistogram(t, processor.workflowStepDuration.WithLabelValues("myorg/myrepo", "Deploy", "deploy", "Smoke test"), 1, 5)
+}
+
+func TestWorkflowJobBilling(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	billing := DefaultConfig().Billing
+	billing.SKUPrices = map[string]float64{"ubuntu-latest-16-cores": 0.064}
+	billing.SelfHostedPricePerHour = map[string]float64{"gpu-pool": 3, DefaultRunnerGroupPrice: 0.5}
+	processor := NewMetricsProcessor(logger, registry, WithBilling(billing))
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	process := func(id int64, labels []string, group string, duration time.Duration) {
+		job := WorkflowJob{
+			ID:              id,
+			RunID:           100,
+			Name:            "build",
+			WorkflowName:    "CI",
+			Repository:      "myorg/myrepo",
+			Status:          WorkflowRunStatusCompleted,
+			Conclusion:      WorkflowRunConclusionSuccess,
+			Labels:          labels,
+			RunnerGroupName: group,
+			StartedAt:       start,
+			CompletedAt:     start.Add(duration),
+		}
+		require.NoError(t, processor.ProcessWorkflowJob(context.Background(), job))
+		// Repeated completions are not billed again
+		require.NoError(t, processor.ProcessWorkflowJob(context.Background(), job))
+	}
+
+	minutes := func(sku string) float64 {
+		return testutil.ToFloat64(processor.billableMinutes.WithLabelValues("myorg/myrepo", "CI", "github_hosted", sku))
+	}
+	cost := func(runnerType, sku, group string) float64 {
+		return testutil.ToFloat64(processor.estimatedCost.WithLabelValues("myorg/myrepo", "CI", runnerType, sku, group))
+	}
+
+	// Hosted jobs are rounded up to the next minute and scaled by the OS multiplier
+	process(1, []string{"ubuntu-latest"}, "GitHub Actions", 90*time.Second)
+	process(2, []string{"windows-latest"}, "GitHub Actions", 3*time.Minute)
+	process(3, []string{"macos-14"}, "GitHub Actions", 30*time.Second)
+	assert.Equal(t, 2.0, minutes("linux"))
+	assert.InDelta(t, 0.016, cost("github_hosted", "linux", "GitHub Actions"), 1e-9)
+	assert.Equal(t, 6.0, minutes("windows"))
+	assert.InDelta(t, 0.048, cost("github_hosted", "windows", "GitHub Actions"), 1e-9)
+	assert.Equal(t, 10.0, minutes("macos"))
+	assert.InDelta(t, 0.08, cost("github_hosted", "macos", "GitHub Actions"), 1e-9)
+
+	// Larger runners are billed at the price of their SKU, whatever their runner group
+	process(4, []string{"Ubuntu-Latest-16-Cores"}, "Default", 10*time.Minute)
+	assert.Equal(t, 10.0, minutes("ubuntu-latest-16-cores"))
+	assert.InDelta(t, 0.64, cost("github_hosted", "ubuntu-latest-16-cores", "Default"), 1e-9)
+
+	// Self-hosted runners are not billed by GitHub, their busy time is priced per runner group
+	process(5, []string{"self-hosted", "gpu"}, "gpu-pool", 30*time.Minute)
+	process(6, []string{"self-hosted", "linux"}, "default", 2*time.Hour)
+	assert.InDelta(t, 1.5, cost("self_hosted", "", "gpu-pool"), 1e-9)
+	assert.InDelta(t, 1.0, cost("self_hosted", "", "default"), 1e-9)
+
+	// Runner scale sets do not request the self-hosted label, their runner group tells them apart
+	process(7, []string{"arc-runner-set"}, "arc", 10*time.Minute)
+	assert.InDelta(t, 0.5/6, cost("self_hosted", "", "arc"), 1e-9)
+	assert.Equal(t, 4, testutil.CollectAndCount(processor.billableMinutes))
+	assert.Equal(t, 7, testutil.CollectAndCount(processor.estimatedCost))
+}
+
+func TestSplitMatrixJobName(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   string
+		values []string
+	}{
+		{"build", "build", nil},
+		{"test (ubuntu-latest, 1.22)", "test", []string{"ubuntu-latest", "1.22"}},
+		{"lint (stable)", "lint", []string{"stable"}},
+		{"call / test (macos-14, 1.21)", "call / test", []string{"macos-14", "1.21"}},
+		{"deploy (prod", "deploy (prod", nil},
+		{"Deploy (prod) (ubuntu, 1.22)", "Deploy (prod)", []string{"ubuntu", "1.22"}},
+		// A name ending in parentheses cannot be told apart from a matrix job
+		{"Build (docker)", "Build", []string{"docker"}},
+	}
+
+	for _, tt := range tests {
+		base, values := splitMatrixJobName(tt.name)
+		assert.Equal(t, tt.base, base, tt.name)
+		assert.Equal(t, tt.values, values, tt.name)
+	}
+}
+
+func TestWorkflowJobMatrix(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithSeriesTTL(time.Hour, nil), WithMatrix(MatrixConfig{
+		Dimensions:            map[string][]string{"test": {"os", "go"}},
+		MaxCombinationsPerJob: 2,
+	}))
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	processor.now = func() time.Time { return now }
+
+	process := func(id int64, name string) {
+		err := processor.ProcessWorkflowJob(context.Background(), WorkflowJob{
+			ID:           id,
+			RunID:        100,
+			Name:         name,
+			WorkflowName: "CI",
+			Repository:   "myorg/myrepo",
+			Status:       WorkflowRunStatusCompleted,
+			Conclusion:   WorkflowRunConclusionSuccess,
+		})
+		require.NoError(t, err)
+	}
+
+	process(1, "test (ubuntu-latest, 1.22)")
+	process(2, "test (macos-14, 1.22)")
+	process(3, "lint (stable)")
+	process(4, "build")
+
+	// Combinations beyond the limit are folded into the overflow combination
+	process(5, "test (windows-latest, 1.22)")
+	process(6, "test (windows-latest, 1.21)")
+	process(7, "test (ubuntu-latest, 1.22)")
+
+	expected := `
+# HELP github_workflow_jobs_total Total number of completed workflow jobs, counted once per job
+# TYPE github_workflow_jobs_total counter
+github_workflow_jobs_total{conclusion="success",go="",job="build",matrix="",os="",repository="myorg/myrepo",workflow="CI"} 1
+github_workflow_jobs_total{conclusion="success",go="",job="lint",matrix="stable",os="",repository="myorg/myrepo",workflow="CI"} 1
+github_workflow_jobs_total{conclusion="success",go="",job="test",matrix="__overflow__",os="",repository="myorg/myrepo",workflow="CI"} 2
+github_workflow_jobs_total{conclusion="success",go="1.22",job="test",matrix="macos-14, 1.22",os="macos-14",repository="myorg/myrepo",workflow="CI"} 1
+github_workflow_jobs_total{conclusion="success",go="1.22",job="test",matrix="ubuntu-latest, 1.22",os="ubuntu-latest",repository="myorg/myrepo",workflow="CI"} 2
+`
+	assert.NoError(t, testutil.CollectAndCompare(processor.workflowJobsTotal, strings.NewReader(expected)))
+	assert.Equal(t, 5, testutil.CollectAndCount(processor.workflowJobStatus))
+
+	// An expired combination is deleted with its dimensions and frees its place under the limit
+	now = now.Add(45 * time.Minute)
+	process(8, "test (ubuntu-latest, 1.22)")
+	now = now.Add(30 * time.Minute)
+	processor.prune(now)
+	process(9, "test (windows-latest, 1.22)")
+
+	expected = `
+# HELP github_workflow_jobs_total Total number of completed workflow jobs, counted once per job
+# TYPE github_workflow_jobs_total counter
+github_workflow_jobs_total{conclusion="success",go="1.22",job="test",matrix="ubuntu-latest, 1.22",os="ubuntu-latest",repository="myorg/myrepo",workflow="CI"} 3
+github_workflow_jobs_total{conclusion="success",go="1.22",job="test",matrix="windows-latest, 1.22",os="windows-latest",repository="myorg/myrepo",workflow="CI"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(processor.workflowJobsTotal, strings.NewReader(expected)))
+	assert.Equal(t, 2, testutil.CollectAndCount(processor.workflowJobStatus))
+}
+
+func TestMatrixConfigValidation(t *testing.T) {
+	for _, names := range [][]string{{"os-name"}, {"job"}, {"os", "os"}, {"__os"}} {
+		_, err := compileMatrixDimensions(MatrixConfig{Dimensions: map[string][]string{"test": names}})
+		assert.Error(t, err, "dimensions %v", names)
+	}
+
+	dimensions, err := compileMatrixDimensions(MatrixConfig{Dimensions: map[string][]string{
+		"test":  {"os", "go"},
+		"build": {"os", "arch"},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"arch", "go", "os"}, dimensions)
+}
@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// runTrackingRetention bounds how long the phases of a completed run are remembered to
+// deduplicate repeated deliveries
+const runTrackingRetention = 24 * time.Hour
+
+// runKey identifies a single attempt of a workflow run
+type runKey struct {
+	id      int64
+	attempt int
+}
+
+// runPhases records when a workflow run entered each phase of its lifecycle
+type runPhases struct {
+	requestedAt  time.Time
+	inProgressAt time.Time
+	completedAt  time.Time
+	queueSeen    bool      // Whether the queue time has been observed for this run
+	lastSeen     time.Time // Wall clock time of the last event for this run
+
+	// Phase the run is counted in by the active run gauges, empty once completed
+	active     WorkflowRunStatus
+	repository string
+	workflow   string
+	class      BranchClass
+}
+
+// setActive moves the run to another phase of the active run gauges. Must be called with p.mu held.
+func (p *MetricsProcessor) setActive(phases *runPhases, status WorkflowRunStatus) {
+	if phases.active == status {
+		return
+	}
+
+	switch phases.active {
+	case WorkflowRunStatusQueued:
+		p.workflowRunsQueued.WithLabelValues(phases.repository, phases.workflow).Dec()
+	case WorkflowRunStatusInProgress:
+		p.workflowRunsInProgress.WithLabelValues(phases.repository, phases.workflow).Dec()
+	}
+
+	switch status {
+	case WorkflowRunStatusQueued:
+		p.workflowRunsQueued.WithLabelValues(phases.repository, phases.workflow).Inc()
+	case WorkflowRunStatusInProgress:
+		p.workflowRunsInProgress.WithLabelValues(phases.repository, phases.workflow).Inc()
+	}
+
+	phases.active = status
+}
+
+// trackRunPhases records the phase timestamps of a run and observes the phase durations.
+// It reports whether this event is the first completion seen for the run attempt, so that
+// repeated completed deliveries are only accounted once. Must be called with p.mu held.
+func (p *MetricsProcessor) trackRunPhases(run WorkflowRun) bool {
+	now := p.now()
+
+	// Prefer the time GitHub reports for the transition, fall back to the time we received it
+	at := run.UpdatedAt
+	if at.IsZero() {
+		at = now
+	}
+
+	key := runKey{id: run.ID, attempt: run.RunAttempt}
+	phases, ok := p.runPhases[key]
+	if !ok {
+		phases = &runPhases{repository: run.Repository, workflow: run.Name, class: run.BranchClass()}
+		p.runPhases[key] = phases
+	}
+	p.trackRerun(run, key)
+	phases.lastSeen = now
+
+	switch run.Status {
+	case WorkflowRunStatusRequested, WorkflowRunStatusQueued, WorkflowRunStatusWaiting, WorkflowRunStatusPending:
+		if phases.requestedAt.IsZero() {
+			phases.requestedAt = at
+		}
+		if phases.inProgressAt.IsZero() && phases.completedAt.IsZero() {
+			p.setActive(phases, WorkflowRunStatusQueued)
+		}
+	case WorkflowRunStatusInProgress:
+		if phases.completedAt.IsZero() {
+			p.setActive(phases, WorkflowRunStatusInProgress)
+		}
+		if phases.inProgressAt.IsZero() {
+			phases.inProgressAt = at
+			if !phases.requestedAt.IsZero() && !at.Before(phases.requestedAt) {
+				observeWithExemplar(p.workflowRunPhase.WithLabelValues(run.Repository, run.Name, string(run.BranchClass()), string(run.Origin()), "queued"), at.Sub(phases.requestedAt).Seconds(), runExemplar(run))
+			}
+		}
+		p.observeQueueTime(run, phases)
+	case WorkflowRunStatusCompleted:
+		p.observeQueueTime(run, phases)
+		if !phases.completedAt.IsZero() {
+			return false
+		}
+		phases.completedAt = at
+		p.setActive(phases, "")
+		if !phases.inProgressAt.IsZero() && !at.Before(phases.inProgressAt) {
+			observeWithExemplar(p.workflowRunPhase.WithLabelValues(run.Repository, run.Name, string(run.BranchClass()), string(run.Origin()), "executing"), at.Sub(phases.inProgressAt).Seconds(), runExemplar(run))
+		}
+		return true
+	}
+
+	return false
+}
+
+// observeQueueTime records the time between the creation and the start of a run, once per run
+func (p *MetricsProcessor) observeQueueTime(run WorkflowRun, phases *runPhases) {
+	if phases.queueSeen {
+		return
+	}
+	if run.CreatedAt.IsZero() || run.StartedAt.IsZero() || run.StartedAt.Before(run.CreatedAt) {
+		p.logger.Debug("Skipping queue time for workflow run without valid timestamps",
+			zap.Int64("runID", run.ID))
+		return
+	}
+
+	phases.queueSeen = true
+	observeWithExemplar(p.workflowRunQueue.WithLabelValues(run.Repository, run.Name, string(run.BranchClass()), string(run.Origin())), run.StartedAt.Sub(run.CreatedAt).Seconds(), runExemplar(run))
+}
+
+// pruneRunPhases forgets completed runs after the retention period, and reaps active runs
+// that did not receive an event within the run timeout. Must be called with p.mu held.
+func (p *MetricsProcessor) pruneRunPhases(now time.Time) {
+	for key, phases := range p.runPhases {
+		if phases.active == "" {
+			if now.Sub(phases.lastSeen) > runTrackingRetention {
+				delete(p.runPhases, key)
+			}
+			continue
+		}
+
+		if p.cfg.RunTimeout > 0 && now.Sub(phases.lastSeen) > p.cfg.RunTimeout {
+			p.setActive(phases, "")
+			delete(p.runPhases, key)
+			p.reapedRuns.WithLabelValues(phases.repository).Inc()
+			p.logger.Debug("Reaped workflow run without completion",
+				zap.Int64("runID", key.id),
+				zap.Int("runAttempt", key.attempt),
+				zap.String("repository", phases.repository))
+		}
+	}
+}
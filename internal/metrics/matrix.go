@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OverflowMatrix is the matrix label value that new combinations are folded into once the per-job limit is reached
+const OverflowMatrix = "__overflow__"
+
+// MatrixConfig controls how the names of matrix jobs, e.g. "test (ubuntu-latest, 1.22)", are
+// split into the base job name and the matrix values
+type MatrixConfig struct {
+	// Dimensions name the matrix values by base job name, e.g. test: [os, go]. Each name becomes a
+	// label of the job metrics.
+	Dimensions map[string][]string `yaml:"dimensions"`
+
+	// MaxCombinationsPerJob limits the number of matrix combinations exposed per job; zero means no limit
+	MaxCombinationsPerJob int `yaml:"max_combinations_per_job"`
+}
+
+// dimensionNameRegex matches the names that can be used as matrix dimension labels
+var dimensionNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// compileMatrixDimensions validates the dimension names and returns their sorted union
+func compileMatrixDimensions(cfg MatrixConfig) ([]string, error) {
+	var dimensions []string
+	for job, names := range cfg.Dimensions {
+		for i, name := range names {
+			if slices.Contains(names[:i], name) {
+				return nil, fmt.Errorf("matrix dimensions of job %q: duplicate label name %q", job, name)
+			}
+			if !dimensionNameRegex.MatchString(name) || strings.HasPrefix(name, "__") {
+				return nil, fmt.Errorf("matrix dimensions of job %q: invalid label name %q", job, name)
+			}
+			switch name {
+			case "repository", "workflow", "job", "matrix", "conclusion":
+				return nil, fmt.Errorf("matrix dimensions of job %q: label name %q is reserved", job, name)
+			}
+			if !slices.Contains(dimensions, name) {
+				dimensions = append(dimensions, name)
+			}
+		}
+	}
+	slices.Sort(dimensions)
+	return dimensions, nil
+}
+
+// splitMatrixJobName splits a job name such as "test (ubuntu-latest, 1.22)" into its base name
+// and its matrix values. GitHub appends the matrix values to the job name, so they are read from
+// the last parenthesis and a base name may contain parentheses itself. Names without matrix values
+// are returned as they are.
+func splitMatrixJobName(name string) (string, []string) {
+	open := strings.LastIndex(name, " (")
+	if open < 0 || !strings.HasSuffix(name, ")") {
+		return name, nil
+	}
+
+	values := strings.Split(name[open+2:len(name)-1], ", ")
+	return name[:open], values
+}
+
+// jobNameKey identifies a job by its base name, across matrix combinations
+type jobNameKey struct {
+	repository string
+	workflow   string
+	job        string
+}
+
+// jobNameState bounds the matrix combinations and step names exposed for a job
+type jobNameState struct {
+	combinations map[string]bool
+	steps        map[string]bool
+}
+
+// jobIdentity resolves the series key and the label values of a job, splitting matrix job names
+// and folding combinations beyond MaxCombinationsPerJob into the overflow combination. The label
+// values are the repository, the workflow, the base job name, the matrix values and the
+// configured dimensions. Must be called with p.mu held.
+func (p *MetricsProcessor) jobIdentity(run WorkflowRun, job WorkflowJob) (jobSeriesKey, []string) {
+	base, values := splitMatrixJobName(job.Name)
+	key := jobSeriesKey{repository: run.Repository, workflow: run.Name, job: base, matrix: strings.Join(values, ", ")}
+
+	state, ok := p.jobNames[key.nameKey()]
+	if !ok {
+		state = &jobNameState{combinations: make(map[string]bool)}
+		p.jobNames[key.nameKey()] = state
+	}
+
+	dimensions := make([]string, len(p.matrixDimensions))
+	if key.matrix == "" {
+		return key, append(key.labels(), dimensions...)
+	}
+
+	if !state.combinations[key.matrix] {
+		if p.cfg.Matrix.MaxCombinationsPerJob > 0 && len(state.combinations) >= p.cfg.Matrix.MaxCombinationsPerJob {
+			key.matrix = OverflowMatrix
+			return key, append(key.labels(), dimensions...)
+		}
+		state.combinations[key.matrix] = true
+	}
+
+	// Name the values when the job has as many dimensions as values
+	if names := p.cfg.Matrix.Dimensions[base]; len(names) == len(values) {
+		for i, name := range names {
+			dimensions[slices.Index(p.matrixDimensions, name)] = values[i]
+		}
+	}
+	return key, append(key.labels(), dimensions...)
+}
+
+// pruneJobNames forgets the matrix combinations and step names of jobs once all their series
+// expired, and deletes their step series. Must be called with p.mu held, after pruneJobs.
+func (p *MetricsProcessor) pruneJobNames() {
+	live := make(map[jobNameKey]bool, len(p.jobNames))
+	for key := range p.jobSeries {
+		live[key.nameKey()] = true
+	}
+
+	for key := range p.jobNames {
+		if live[key] {
+			continue
+		}
+
+		labels := prometheus.Labels{"repository": key.repository, "workflow": key.workflow, "job": key.job}
+		p.workflowStepDuration.DeletePartialMatch(labels)
+		p.workflowStepFailures.DeletePartialMatch(labels)
+		delete(p.jobNames, key)
+	}
+}
@@ -0,0 +1,23 @@
+package metrics
+
+// Origin tells whether a workflow run was triggered from the repository itself or from a fork
+type Origin string
+
+// Constants for run origins
+const (
+	OriginSameRepo Origin = "same_repo"
+	OriginFork     Origin = "fork"
+)
+
+// Origin classifies the run by comparing its head repository with the base repository.
+// Runs without a head repository are treated as same repository runs.
+func (r WorkflowRun) Origin() Origin {
+	if r.origin != "" {
+		return r.origin
+	}
+
+	if r.HeadRepository != "" && r.HeadRepository != r.Repository {
+		return OriginFork
+	}
+	return OriginSameRepo
+}
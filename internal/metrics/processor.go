@@ -2,12 +2,18 @@ package metrics
 
 import (
 	"context"
+	"fmt"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
+// pruneInterval is the minimum time between two sweeps of the internal state
+const pruneInterval = time.Minute
+
 // WorkflowRunStatus represents the status of a workflow run
 type WorkflowRunStatus string
 
@@ -19,6 +25,9 @@ const (
 	WorkflowRunStatusCompleted  WorkflowRunStatus = "completed"
 	WorkflowRunStatusInProgress WorkflowRunStatus = "in_progress"
 	WorkflowRunStatusRequested  WorkflowRunStatus = "requested"
+	WorkflowRunStatusQueued     WorkflowRunStatus = "queued"
+	WorkflowRunStatusWaiting    WorkflowRunStatus = "waiting"
+	WorkflowRunStatusPending    WorkflowRunStatus = "pending"
 )
 
 // Constants for workflow run conclusions
@@ -37,28 +46,130 @@ const (
 
 // WorkflowRun represents a workflow run event
 type WorkflowRun struct {
-	ID         int64
-	Name       string
-	Repository string
-	Status     WorkflowRunStatus
-	Conclusion WorkflowRunConclusion
-	StartedAt  time.Time
-	UpdatedAt  time.Time
-	Branch     string
-	Trigger    string
-	RefType    string // "branch" or "tag"
+	ID             int64
+	RunNumber      int
+	Name           string
+	WorkflowID     int64
+	WorkflowPath   string // Path of the workflow file, e.g. ".github/workflows/ci.yml"
+	Repository     string
+	HeadRepository string // Full name of the repository the head commit comes from, differs from Repository for forks
+	Status         WorkflowRunStatus
+	Conclusion     WorkflowRunConclusion
+	RunAttempt     int
+	CreatedAt      time.Time
+	StartedAt      time.Time
+	UpdatedAt      time.Time
+	Branch         string
+	DefaultBranch  string // Default branch of the repository, if known
+	BaseBranch     string // Base branch of the pull request the run belongs to, if any
+	Trigger        string
+	RefType        string // "branch" or "tag"
+	HeadSHA        string
+	Actor          string // Login of the user that triggered the run
+	HTMLURL        string // Link to the run on GitHub
+
+	branchClass BranchClass // Branch class determined before relabeling
+	origin      Origin      // Origin determined before relabeling
 }
 
 // MetricsProcessor processes GitHub webhook events and updates metrics
 type MetricsProcessor struct {
-	logger *zap.Logger
+	logger  *zap.Logger
+	cfg     Config
+	now     func() time.Time
+	relabel []relabelRule
+	filter  eventFilter
+
+	// Sorted names of the matrix dimension labels of the job metrics
+	matrixDimensions []string
 
 	// Prometheus metrics
-	workflowStatus *prometheus.GaugeVec // New gauge metric for workflow status
+	workflowStatus      *prometheus.GaugeVec     // New gauge metric for workflow status
+	workflowRunDuration *prometheus.HistogramVec // Duration of completed workflow runs
+	workflowRunQueue    *prometheus.HistogramVec // Time between run creation and run start
+	workflowRunPhase    *prometheus.HistogramVec // Time spent in the queued and executing phases
+	workflowRunsTotal   *prometheus.CounterVec   // Completed workflow runs by conclusion
+	pullRequestRuns     *prometheus.CounterVec   // Completed pull request runs by base branch
+	workflowRunReruns   *prometheus.CounterVec   // Re-run attempts of workflow runs
+	workflowRunAttempt  *prometheus.GaugeVec     // Latest attempt number of workflow runs
+	workflowRunsFlaky   *prometheus.CounterVec   // Runs that failed and then succeeded on a re-run
+	workflowLastRun     *prometheus.GaugeVec     // Time of the latest run update
+	workflowLastSuccess *prometheus.GaugeVec     // Time of the latest successful run
+	workflowLastFailure *prometheus.GaugeVec     // Time of the latest failed run
+	workflowRunInfo     *prometheus.GaugeVec     // Metadata of the latest runs
+	workflowInfo        *prometheus.GaugeVec     // Current name and path of workflows
+
+	workflowRunsQueued     *prometheus.GaugeVec // Runs currently waiting to start
+	workflowRunsInProgress *prometheus.GaugeVec // Runs currently executing
+
+	workflowJobStatus   *prometheus.GaugeVec     // Status of the latest job by job name
+	workflowJobsTotal   *prometheus.CounterVec   // Completed jobs by conclusion
+	workflowJobDuration *prometheus.HistogramVec // Duration of completed jobs
+	workflowJobQueue    *prometheus.HistogramVec // Time jobs wait for a runner
+
+	workflowStepDuration *prometheus.HistogramVec // Duration of completed steps
+	workflowStepFailures *prometheus.CounterVec   // Failed steps
+
+	billableMinutes *prometheus.CounterVec // Estimated billable minutes of GitHub hosted jobs
+	estimatedCost   *prometheus.CounterVec // Estimated cost of jobs
+
+	runnersBusy            *prometheus.GaugeVec   // Runners currently executing a job, by runner group
+	runnerGroupJobs        *prometheus.CounterVec // Completed jobs by runner group
+	runnerGroupBusySeconds *prometheus.CounterVec // Time runners of a group spent executing jobs
+	runnerJobs             *prometheus.CounterVec // Completed jobs by self-hosted runner
+	runnerBusySeconds      *prometheus.CounterVec // Time self-hosted runners spent executing jobs
+
+	jobsQueued     *prometheus.GaugeVec // Jobs waiting for a runner, by runner label set
+	jobsInProgress *prometheus.GaugeVec // Jobs executing on a runner, by runner label set
+
+	workflowJobsWaiting     *prometheus.GaugeVec     // Jobs waiting on their environment
+	workflowJobApprovalWait *prometheus.HistogramVec // Time jobs waited on their environment
+
+	// Self metrics
+	evictedSeries  *prometheus.CounterVec // Label sets removed after their TTL expired
+	seriesCount    *prometheus.GaugeVec   // Current number of label sets per repository
+	overflowEvents *prometheus.CounterVec // Events folded into the overflow branch
+	droppedEvents  *prometheus.CounterVec // Events dropped by filters and relabel rules
+	staleEvents    *prometheus.CounterVec // Out of order events that did not update gauges
+	reapedRuns     *prometheus.CounterVec // Active runs dropped after the run timeout
+
+	// Lifecycle state of the runs seen so far, guarded by mu
+	mu                  sync.Mutex
+	series              map[seriesKey]*seriesState
+	workflows           map[workflowKey]*workflowInfoState
+	seriesPerRepository map[string]int
+	runPhases           map[runKey]*runPhases
+	failedRuns          map[int64]time.Time
+	reruns              map[runKey]time.Time // Re-run attempts seen, by last event
+	droppedRuns         map[runKey]droppedRun
+	jobSeries           map[jobSeriesKey]*jobSeriesState
+	jobQueueSeries      map[string]classUpdates // Queue time label sets, by runner label set
+	jobNames            map[jobNameKey]*jobNameState
+	jobs                map[int64]*jobState
+	busyRunners         map[runnerKey]*busyRunner
+	runners             map[runnerKey]*runnerState
+	backlog             map[string]int // Queued jobs by runner label set
+	inProgress          map[string]int // In progress jobs by runner label set
+	approvals           map[int64]*approvalState
+	lastPrune           time.Time
 }
 
-// NewMetricsProcessor creates a new metrics processor
-func NewMetricsProcessor(logger *zap.Logger, registry *prometheus.Registry) *MetricsProcessor {
+// NewMetricsProcessor creates a new metrics processor. Like the registration of its metrics, it
+// panics if the configuration is invalid; use Config.Validate to check a configuration first.
+func NewMetricsProcessor(logger *zap.Logger, registry *prometheus.Registry, opts ...Option) *MetricsProcessor {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		panic(fmt.Sprintf("invalid metrics configuration: %v", err))
+	}
+
+	// The configuration is valid, so compiling it cannot fail
+	relabelRules, _ := compileRelabelConfigs(cfg.RelabelConfigs)
+	filter, _ := compileFilters(cfg.Filters)
+	matrixDimensions, _ := compileMatrixDimensions(cfg.Matrix)
+	jobLabels := jobLabelNames(matrixDimensions)
 
 	// Create new gauge for workflow status
 	workflowStatus := prometheus.NewGaugeVec(
@@ -69,48 +180,587 @@ func NewMetricsProcessor(logger *zap.Logger, registry *prometheus.Registry) *Met
 		[]string{"repository", "workflow", "branch", "trigger", "ref_type"},
 	)
 
+	// Create new histogram for the duration of completed workflow runs
+	workflowRunDuration := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "github_workflow_run_duration_seconds",
+			Help:    "Duration of completed workflow runs, from run start to last update, in seconds",
+			Buckets: cfg.DurationBuckets,
+		},
+		[]string{"repository", "workflow", "branch_class", "origin", "conclusion"},
+	)
+
+	// Create new histogram for the time runs wait before they start
+	workflowRunQueue := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "github_workflow_run_queue_seconds",
+			Help:    "Time between the creation and the start of workflow runs, in seconds",
+			Buckets: cfg.QueueBuckets,
+		},
+		[]string{"repository", "workflow", "branch_class", "origin"},
+	)
+
+	// Create new histogram for the time runs spend in each lifecycle phase
+	workflowRunPhase := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "github_workflow_run_phase_seconds",
+			Help:    "Time workflow runs spend queued (requested to in_progress) and executing (in_progress to completed), in seconds",
+			Buckets: mergeBuckets(cfg.QueueBuckets, cfg.DurationBuckets),
+		},
+		[]string{"repository", "workflow", "branch_class", "origin", "phase"},
+	)
+
+	// Create new counter for completed workflow runs
+	workflowRunsTotal := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_workflow_runs_total",
+			Help: "Total number of completed workflow runs, counted once per run attempt",
+		},
+		[]string{"repository", "workflow", "branch_class", "origin", "conclusion"},
+	)
+
+	// Create new counter for completed pull request runs
+	pullRequestRuns := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_workflow_pull_request_runs_total",
+			Help: "Total number of completed workflow runs triggered by pull requests, by base branch",
+		},
+		[]string{"repository", "workflow", "base_branch", "origin", "conclusion"},
+	)
+
+	// Create new counter for re-run attempts
+	workflowRunReruns := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_workflow_run_reruns_total",
+			Help: "Total number of workflow run attempts beyond the first one",
+		},
+		[]string{"repository", "workflow", "branch_class", "origin"},
+	)
+
+	// Create new gauge for the latest attempt number
+	workflowRunAttempt := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_workflow_run_attempt",
+			Help: "Attempt number of the latest workflow run",
+		},
+		[]string{"repository", "workflow", "branch", "trigger", "ref_type"},
+	)
+
+	// Create new counter for runs that only passed on a re-run
+	workflowRunsFlaky := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_workflow_runs_flaky_total",
+			Help: "Total number of workflow runs that failed on an attempt and succeeded on a later attempt",
+		},
+		[]string{"repository", "workflow", "branch_class", "origin"},
+	)
+
+	// Create new gauges for the time of the latest run, success and failure
+	workflowLastRun := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_workflow_last_run_timestamp_seconds",
+			Help: "Unix time of the latest update of any workflow run",
+		},
+		[]string{"repository", "workflow", "branch", "trigger", "ref_type"},
+	)
+	workflowLastSuccess := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_workflow_last_success_timestamp_seconds",
+			Help: "Unix time of the completion of the latest successful workflow run",
+		},
+		[]string{"repository", "workflow", "branch", "trigger", "ref_type"},
+	)
+	workflowLastFailure := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_workflow_last_failure_timestamp_seconds",
+			Help: "Unix time of the completion of the latest failed (failure, timed_out or startup_failure) workflow run",
+		},
+		[]string{"repository", "workflow", "branch", "trigger", "ref_type"},
+	)
+
+	// Create new info gauge with the metadata of the latest runs
+	workflowRunInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_workflow_run_info",
+			Help: "Metadata of the latest workflow runs, always 1",
+		},
+		[]string{"repository", "workflow", "branch", "trigger", "ref_type", "run_id", "run_number", "head_sha", "actor", "html_url"},
+	)
+
+	// Create new info gauge mapping workflow IDs to their current name
+	workflowInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_workflow_info",
+			Help: "Current name and path of workflows, by workflow ID, always 1",
+		},
+		[]string{"repository", "workflow", "workflow_id", "workflow_path", "workflow_name"},
+	)
+
+	// Create new gauges for the runs that are currently queued or executing
+	workflowRunsQueued := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_workflow_runs_queued",
+			Help: "Number of workflow runs that are requested but not yet in progress",
+		},
+		[]string{"repository", "workflow"},
+	)
+	workflowRunsInProgress := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_workflow_runs_in_progress",
+			Help: "Number of workflow runs that are currently in progress",
+		},
+		[]string{"repository", "workflow"},
+	)
+
+	// Create new gauge for the status of the latest job of each job name
+	workflowJobStatus := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_workflow_job_status",
+			Help: "Current status of workflow jobs, with the same values as github_workflow_status",
+		},
+		jobLabels,
+	)
+
+	// Create new counter for completed jobs
+	workflowJobsTotal := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_workflow_jobs_total",
+			Help: "Total number of completed workflow jobs, counted once per job",
+		},
+		append(slices.Clone(jobLabels), "conclusion"),
+	)
+
+	// Create new histogram for the duration of completed jobs
+	workflowJobDuration := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "github_workflow_job_duration_seconds",
+			Help:    "Duration of completed workflow jobs, from job start to job completion, in seconds",
+			Buckets: cfg.DurationBuckets,
+		},
+		append(slices.Clone(jobLabels), "conclusion"),
+	)
+
+	// Create new histogram for the time jobs wait for a runner
+	workflowJobQueue := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "github_workflow_job_queue_seconds",
+			Help:    "Time between the creation and the start of workflow jobs, by runner label set, in seconds",
+			Buckets: cfg.QueueBuckets,
+		},
+		[]string{"runner_labels"},
+	)
+
+	// Create new histogram and counter for the steps of completed jobs
+	workflowStepDuration := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "github_workflow_step_duration_seconds",
+			Help:    "Duration of the completed steps of workflow jobs, in seconds",
+			Buckets: mergeBuckets(cfg.QueueBuckets, cfg.DurationBuckets),
+		},
+		[]string{"repository", "workflow", "job", "step"},
+	)
+	workflowStepFailures := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_workflow_step_failures_total",
+			Help: "Total number of failed steps of workflow jobs",
+		},
+		[]string{"repository", "workflow", "job", "step"},
+	)
+
+	// Create new counters for the estimated billable minutes and cost of jobs
+	billableMinutes := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_actions_billable_minutes_total",
+			Help: "Estimated billable minutes of completed workflow jobs on GitHub hosted runners",
+		},
+		[]string{"repository", "workflow", "runner_type", "runner_sku"},
+	)
+	estimatedCost := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_actions_estimated_cost_total",
+			Help: "Estimated cost of completed workflow jobs, in the currency of the configured price table",
+		},
+		[]string{"repository", "workflow", "runner_type", "runner_sku", "runner_group"},
+	)
+
+	// Create new gauge for the runners that are currently executing a job
+	runnersBusy := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_actions_runners_busy",
+			Help: "Number of runners currently executing a job, by runner group",
+		},
+		[]string{"runner_group", "runner_type"},
+	)
+
+	// Create new counters for the jobs and busy time of runner groups
+	runnerGroupJobs := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_actions_runner_group_jobs_total",
+			Help: "Total number of completed workflow jobs, by runner group",
+		},
+		[]string{"runner_group", "runner_type"},
+	)
+	runnerGroupBusySeconds := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_actions_runner_group_busy_seconds_total",
+			Help: "Total time runners of a runner group spent executing workflow jobs, in seconds",
+		},
+		[]string{"runner_group", "runner_type"},
+	)
+
+	// Create new counters for the jobs and busy time of self-hosted runners
+	runnerJobs := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_actions_runner_jobs_total",
+			Help: "Total number of completed workflow jobs, by self-hosted runner",
+		},
+		[]string{"runner_group", "runner"},
+	)
+	runnerBusySeconds := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_actions_runner_busy_seconds_total",
+			Help: "Total time self-hosted runners spent executing workflow jobs, in seconds",
+		},
+		[]string{"runner_group", "runner"},
+	)
+
+	// Create new gauges for the jobs that are waiting for or executing on a runner
+	jobsQueued := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_actions_jobs_queued",
+			Help: "Number of workflow jobs currently queued for a runner, by requested runner label set",
+		},
+		[]string{"runner_labels"},
+	)
+	jobsInProgress := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_actions_jobs_in_progress",
+			Help: "Number of workflow jobs currently executing on a runner, by requested runner label set",
+		},
+		[]string{"runner_labels"},
+	)
+
+	// Create new gauge and histogram for the jobs waiting on environment approvals
+	workflowJobsWaiting := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_workflow_jobs_waiting",
+			Help: "Number of workflow jobs currently waiting on their deployment environment",
+		},
+		[]string{"repository", "environment"},
+	)
+	workflowJobApprovalWait := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "github_workflow_job_approval_wait_seconds",
+			Help:    "Time workflow jobs waited on their deployment environment until they were approved or rejected",
+			Buckets: mergeBuckets(cfg.QueueBuckets, cfg.DurationBuckets),
+		},
+		[]string{"repository", "environment", "outcome"},
+	)
+
+	// Create new counter for label sets removed by the TTL
+	evictedSeries := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_actions_exporter_evicted_series_total",
+			Help: "Total number of workflow label sets removed because they were not updated within their TTL",
+		},
+		[]string{"branch_class"},
+	)
+
+	// Create new gauge for the number of tracked label sets
+	seriesCount := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "github_actions_exporter_series",
+			Help: "Current number of per-branch workflow label sets, by repository",
+		},
+		[]string{"repository"},
+	)
+
+	// Create new counter for events folded into the overflow branch
+	overflowEvents := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_actions_exporter_overflow_total",
+			Help: "Total number of workflow run events folded into the " + OverflowBranch + " series because a cardinality limit was reached",
+		},
+		[]string{"repository"},
+	)
+
+	// Create new counter for events dropped before metrics are updated
+	droppedEvents := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_actions_exporter_dropped_events_total",
+			Help: "Total number of events dropped by filters and relabel rules, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	// Create new counter for out of order events
+	staleEvents := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_actions_exporter_stale_events_total",
+			Help: "Total number of workflow run events ignored by the status gauges because a newer run or update was already seen",
+		},
+		[]string{"repository"},
+	)
+
+	// Create new counter for active runs that never completed
+	reapedRuns := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "github_actions_exporter_reaped_runs_total",
+			Help: "Total number of queued or in progress workflow runs dropped because no event was received within the run timeout",
+		},
+		[]string{"repository"},
+	)
+
 	// Register all metrics with the Prometheus registry
 	registry.MustRegister(
 		workflowStatus,
+		workflowRunDuration,
+		workflowRunQueue,
+		workflowRunPhase,
+		workflowRunsTotal,
+		pullRequestRuns,
+		workflowRunReruns,
+		workflowRunAttempt,
+		workflowRunsFlaky,
+		workflowLastRun,
+		workflowLastSuccess,
+		workflowLastFailure,
+		workflowRunInfo,
+		workflowInfo,
+		workflowRunsQueued,
+		workflowRunsInProgress,
+		workflowJobStatus,
+		workflowJobsTotal,
+		workflowJobDuration,
+		workflowJobQueue,
+		workflowStepDuration,
+		workflowStepFailures,
+		billableMinutes,
+		estimatedCost,
+		runnersBusy,
+		runnerGroupJobs,
+		runnerGroupBusySeconds,
+		runnerJobs,
+		runnerBusySeconds,
+		jobsQueued,
+		jobsInProgress,
+		workflowJobsWaiting,
+		workflowJobApprovalWait,
+		evictedSeries,
+		seriesCount,
+		overflowEvents,
+		droppedEvents,
+		staleEvents,
+		reapedRuns,
 	)
 
 	return &MetricsProcessor{
-		logger:         logger,
-		workflowStatus: workflowStatus,
+		logger:                  logger,
+		cfg:                     cfg,
+		now:                     time.Now,
+		relabel:                 relabelRules,
+		filter:                  filter,
+		matrixDimensions:        matrixDimensions,
+		workflowStatus:          workflowStatus,
+		workflowRunDuration:     workflowRunDuration,
+		workflowRunQueue:        workflowRunQueue,
+		workflowRunPhase:        workflowRunPhase,
+		workflowRunsTotal:       workflowRunsTotal,
+		pullRequestRuns:         pullRequestRuns,
+		workflowRunReruns:       workflowRunReruns,
+		workflowRunAttempt:      workflowRunAttempt,
+		workflowRunsFlaky:       workflowRunsFlaky,
+		workflowLastRun:         workflowLastRun,
+		workflowLastSuccess:     workflowLastSuccess,
+		workflowLastFailure:     workflowLastFailure,
+		workflowRunInfo:         workflowRunInfo,
+		workflowInfo:            workflowInfo,
+		workflowRunsQueued:      workflowRunsQueued,
+		workflowRunsInProgress:  workflowRunsInProgress,
+		workflowJobStatus:       workflowJobStatus,
+		workflowJobsTotal:       workflowJobsTotal,
+		workflowJobDuration:     workflowJobDuration,
+		workflowJobQueue:        workflowJobQueue,
+		workflowStepDuration:    workflowStepDuration,
+		workflowStepFailures:    workflowStepFailures,
+		billableMinutes:         billableMinutes,
+		estimatedCost:           estimatedCost,
+		runnersBusy:             runnersBusy,
+		runnerGroupJobs:         runnerGroupJobs,
+		runnerGroupBusySeconds:  runnerGroupBusySeconds,
+		runnerJobs:              runnerJobs,
+		runnerBusySeconds:       runnerBusySeconds,
+		jobsQueued:              jobsQueued,
+		jobsInProgress:          jobsInProgress,
+		workflowJobsWaiting:     workflowJobsWaiting,
+		workflowJobApprovalWait: workflowJobApprovalWait,
+		evictedSeries:           evictedSeries,
+		seriesCount:             seriesCount,
+		overflowEvents:          overflowEvents,
+		droppedEvents:           droppedEvents,
+		staleEvents:             staleEvents,
+		reapedRuns:              reapedRuns,
+		series:                  make(map[seriesKey]*seriesState),
+		workflows:               make(map[workflowKey]*workflowInfoState),
+		seriesPerRepository:     make(map[string]int),
+		runPhases:               make(map[runKey]*runPhases),
+		failedRuns:              make(map[int64]time.Time),
+		reruns:                  make(map[runKey]time.Time),
+		droppedRuns:             make(map[runKey]droppedRun),
+		jobSeries:               make(map[jobSeriesKey]*jobSeriesState),
+		jobQueueSeries:          make(map[string]classUpdates),
+		jobNames:                make(map[jobNameKey]*jobNameState),
+		jobs:                    make(map[int64]*jobState),
+		busyRunners:             make(map[runnerKey]*busyRunner),
+		runners:                 make(map[runnerKey]*runnerState),
+		backlog:                 make(map[string]int),
+		inProgress:              make(map[string]int),
+		approvals:               make(map[int64]*approvalState),
 	}
 }
 
 // ProcessWorkflowRun processes a workflow run event
 func (p *MetricsProcessor) ProcessWorkflowRun(ctx context.Context, run WorkflowRun) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.prune(p.now())
+
+	if reason := p.filter.reject(run); reason != "" {
+		p.dropRun(run, reason)
+		p.droppedEvents.WithLabelValues(reason).Inc()
+		p.logger.Debug("Workflow run dropped by filters",
+			zap.Int64("runID", run.ID),
+			zap.String("repository", run.Repository),
+			zap.String("reason", reason))
+		return nil
+	}
 
-	// Update the workflow status gauge
-	statusValue := 9.0 // Default: in_progress
-	if run.Status == WorkflowRunStatusCompleted {
-		switch run.Conclusion {
-		case WorkflowRunConclusionTimedOut:
-			statusValue = 0.0 // Timed out
-		case WorkflowRunConclusionFailure:
-			statusValue = 1.0 // Failure
-		case WorkflowRunConclusionStartupFailure:
-			statusValue = 2.0 // Startup failure
-		case WorkflowRunConclusionCancelled:
-			statusValue = 3.0 // Cancelled
-		case WorkflowRunConclusionSkipped:
-			statusValue = 4.0 // Skipped
-		case WorkflowRunConclusionNeutral:
-			statusValue = 5.0 // Neutral
-		case WorkflowRunConclusionStale:
-			statusValue = 6.0 // Stale
-		case WorkflowRunConclusionNull:
-			statusValue = 7.0 // Null
-		case WorkflowRunConclusionActionRequired:
-			statusValue = 8.0 // Action required
-		case WorkflowRunConclusionSuccess:
-			statusValue = 10.0 // Success
+	// Key the workflow label by the configured identity, before relabel rules see it
+	name := run.Name
+	run.Name = p.workflowLabel(run)
+
+	run, keep := relabel(p.relabel, run)
+	if !keep {
+		p.dropRun(run, DropReasonRelabel)
+		p.droppedEvents.WithLabelValues(DropReasonRelabel).Inc()
+		p.logger.Debug("Workflow run dropped by relabel rules",
+			zap.Int64("runID", run.ID),
+			zap.String("repository", run.Repository))
+		return nil
+	}
+
+	// Only the latest run of a series may update its gauges
+	key, current := p.touchSeries(run)
+	p.updateWorkflowInfo(key, run, name)
+	if current {
+		p.workflowStatus.WithLabelValues(key.labels()...).Set(statusValue(run.Status, run.Conclusion))
+		if run.RunAttempt > 0 {
+			p.workflowRunAttempt.WithLabelValues(key.labels()...).Set(float64(run.RunAttempt))
 		}
+	} else {
+		p.staleEvents.WithLabelValues(run.Repository).Inc()
+		p.logger.Debug("Ignoring out of order workflow run event",
+			zap.Int64("runID", run.ID),
+			zap.Int("runAttempt", run.RunAttempt),
+			zap.String("status", string(run.Status)))
 	}
 
-	p.workflowStatus.WithLabelValues(run.Repository, run.Name, run.Branch, run.Trigger, run.RefType).Set(statusValue)
+	p.updateTimestamps(key, run)
+	p.updateRunInfo(key, run)
+
+	// Account completed runs once, even when GitHub delivers the completion more than once
+	completed := p.trackRunPhases(run)
+	if completed {
+		p.observeRunDuration(run)
+		incWithExemplar(p.workflowRunsTotal.WithLabelValues(run.Repository, run.Name, string(run.BranchClass()), string(run.Origin()), string(run.Conclusion)), runExemplar(run))
+		if run.IsPullRequest() {
+			incWithExemplar(p.pullRequestRuns.WithLabelValues(run.Repository, run.Name, run.BaseBranch, string(run.Origin()), string(run.Conclusion)), runExemplar(run))
+		}
+	}
+
+	p.trackAttempt(run, completed)
 
 	return nil
 }
+
+// statusValue maps the status and conclusion of a run or job to the value of the status gauges
+func statusValue(status WorkflowRunStatus, conclusion WorkflowRunConclusion) float64 {
+	if status != WorkflowRunStatusCompleted {
+		return 9.0 // In progress
+	}
+
+	switch conclusion {
+	case WorkflowRunConclusionTimedOut:
+		return 0.0 // Timed out
+	case WorkflowRunConclusionFailure:
+		return 1.0 // Failure
+	case WorkflowRunConclusionStartupFailure:
+		return 2.0 // Startup failure
+	case WorkflowRunConclusionCancelled:
+		return 3.0 // Cancelled
+	case WorkflowRunConclusionSkipped:
+		return 4.0 // Skipped
+	case WorkflowRunConclusionNeutral:
+		return 5.0 // Neutral
+	case WorkflowRunConclusionStale:
+		return 6.0 // Stale
+	case WorkflowRunConclusionNull:
+		return 7.0 // Null
+	case WorkflowRunConclusionActionRequired:
+		return 8.0 // Action required
+	case WorkflowRunConclusionSuccess:
+		return 10.0 // Success
+	}
+	return 9.0
+}
+
+// observeRunDuration records the duration of a completed workflow run
+func (p *MetricsProcessor) observeRunDuration(run WorkflowRun) {
+	if run.StartedAt.IsZero() || run.UpdatedAt.Before(run.StartedAt) {
+		p.logger.Debug("Skipping duration for workflow run without valid timestamps",
+			zap.Int64("runID", run.ID))
+		return
+	}
+
+	duration := run.UpdatedAt.Sub(run.StartedAt).Seconds()
+	observeWithExemplar(p.workflowRunDuration.WithLabelValues(run.Repository, run.Name, string(run.BranchClass()), string(run.Origin()), string(run.Conclusion)), duration, runExemplar(run))
+}
+
+// prune drops internal state that is no longer needed, at most once per pruneInterval.
+// Must be called with p.mu held.
+func (p *MetricsProcessor) prune(now time.Time) {
+	if now.Sub(p.lastPrune) < pruneInterval {
+		return
+	}
+	p.lastPrune = now
+
+	p.expireSeries(now)
+	p.pruneWorkflows(now)
+	p.pruneRunPhases(now)
+	p.pruneDroppedRuns(now)
+	p.pruneFailedRuns(now)
+	p.pruneBacklog(now)
+	p.pruneApprovals(now)
+	p.pruneJobs(now)
+	p.pruneJobNames()
+	p.pruneRunners(now)
+}
+
+// Run periodically expires stale series and internal state until the context is cancelled,
+// so that cleanup also happens while no webhooks are received
+func (p *MetricsProcessor) Run(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			p.prune(p.now())
+			p.mu.Unlock()
+		}
+	}
+}
@@ -2,11 +2,14 @@ package metrics
 
 import (
 	"context"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
@@ -316,3 +319,813 @@ func TestWorkflowStatusGauge(t *testing.T) {
 	val = testutil.ToFloat64(gauge)
 	assert.Equal(t, 7.0, val, "Expected workflow status gauge to be 7.0 for null")
 }
+
+func TestWorkflowRunDurationHistogram(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithDurationBuckets([]float64{60, 600}))
+
+	startTime := time.Now().Add(-300 * time.Second)
+	endTime := startTime.Add(300 * time.Second)
+
+	// In-progress runs should not be observed
+	err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+		ID:         2001,
+		Name:       "duration-test",
+		Repository: "myorg/myrepo",
+		Status:     WorkflowRunStatusInProgress,
+		StartedAt:  startTime,
+		UpdatedAt:  startTime,
+		Branch:     "main",
+		Trigger:    "push",
+		RefType:    "branch",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, testutil.CollectAndCount(processor.workflowRunDuration))
+
+	// Completed runs should be observed with their duration
+	err = processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+		ID:         2001,
+		Name:       "duration-test",
+		Repository: "myorg/myrepo",
+		Status:     WorkflowRunStatusCompleted,
+		Conclusion: WorkflowRunConclusionSuccess,
+		StartedAt:  startTime,
+		UpdatedAt:  endTime,
+		Branch:     "main",
+		Trigger:    "push",
+		RefType:    "branch",
+	})
+	require.NoError(t, err)
+
+	expected := `
+# HELP github_workflow_run_duration_seconds Duration of completed workflow runs, from run start to last update, in seconds
+# TYPE github_workflow_run_duration_seconds histogram
+github_workflow_run_duration_seconds_bucket{branch_class="default",conclusion="success",origin="same_repo",repository="myorg/myrepo",workflow="duration-test",le="60"} 0
+github_workflow_run_duration_seconds_bucket{branch_class="default",conclusion="success",origin="same_repo",repository="myorg/myrepo",workflow="duration-test",le="600"} 1
+github_workflow_run_duration_seconds_bucket{branch_class="default",conclusion="success",origin="same_repo",repository="myorg/myrepo",workflow="duration-test",le="+Inf"} 1
+github_workflow_run_duration_seconds_sum{branch_class="default",conclusion="success",origin="same_repo",repository="myorg/myrepo",workflow="duration-test"} 300
+github_workflow_run_duration_seconds_count{branch_class="default",conclusion="success",origin="same_repo",repository="myorg/myrepo",workflow="duration-test"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(processor.workflowRunDuration, strings.NewReader(expected)))
+
+	// Completed runs without a start time should not be observed
+	err = processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+		ID:         2002,
+		Name:       "duration-test-no-start",
+		Repository: "myorg/myrepo",
+		Status:     WorkflowRunStatusCompleted,
+		Conclusion: WorkflowRunConclusionFailure,
+		UpdatedAt:  endTime,
+		Branch:     "feature/x",
+		Trigger:    "push",
+		RefType:    "branch",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, testutil.CollectAndCount(processor.workflowRunDuration))
+}
+
+func TestWorkflowRunBranchClass(t *testing.T) {
+	tests := []struct {
+		name     string
+		run      WorkflowRun
+		expected BranchClass
+	}{
+		{"default branch from payload", WorkflowRun{Branch: "develop", DefaultBranch: "develop", RefType: "branch"}, BranchClassDefault},
+		{"main without payload default", WorkflowRun{Branch: "main", RefType: "branch"}, BranchClassDefault},
+		{"main with other default", WorkflowRun{Branch: "main", DefaultBranch: "trunk", RefType: "branch"}, BranchClassFeature},
+		{"release branch", WorkflowRun{Branch: "release/1.2", RefType: "branch"}, BranchClassRelease},
+		{"tag", WorkflowRun{Branch: "v1.0.0", RefType: "tag"}, BranchClassTag},
+		{"feature branch", WorkflowRun{Branch: "feature/login", RefType: "branch"}, BranchClassFeature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.run.BranchClass())
+		})
+	}
+}
+
+func TestWorkflowRunQueueAndPhases(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry)
+
+	createdAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	startedAt := createdAt.Add(45 * time.Second)
+	completedAt := startedAt.Add(10 * time.Minute)
+
+	run := WorkflowRun{
+		ID:         3001,
+		Name:       "queue-test",
+		Repository: "myorg/myrepo",
+		Status:     WorkflowRunStatusQueued,
+		CreatedAt:  createdAt,
+		StartedAt:  createdAt,
+		UpdatedAt:  createdAt,
+		Branch:     "main",
+		Trigger:    "push",
+		RefType:    "branch",
+	}
+
+	// queued
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+	assert.Equal(t, 0, testutil.CollectAndCount(processor.workflowRunQueue))
+
+	// in_progress
+	run.Status = WorkflowRunStatusInProgress
+	run.StartedAt = startedAt
+	run.UpdatedAt = startedAt
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+
+	// completed, delivered twice
+	run.Status = WorkflowRunStatusCompleted
+	run.Conclusion = WorkflowRunConclusionSuccess
+	run.UpdatedAt = completedAt
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+
+	queue, err := processor.workflowRunQueue.GetMetricWithLabelValues("myorg/myrepo", "queue-test", "default", "same_repo")
+	require.NoError(t, err)
+	assertHistogram(t, queue, 1, 45)
+
+	queued, err := processor.workflowRunPhase.GetMetricWithLabelValues("myorg/myrepo", "queue-test", "default", "same_repo", "queued")
+	require.NoError(t, err)
+	assertHistogram(t, queued, 1, 45)
+
+	executing, err := processor.workflowRunPhase.GetMetricWithLabelValues("myorg/myrepo", "queue-test", "default", "same_repo", "executing")
+	require.NoError(t, err)
+	assertHistogram(t, executing, 1, 600)
+}
+
+// stringPtr returns a pointer to the string, for optional configuration fields
+func stringPtr(s string) *string {
+	return &s
+}
+
+// assertHistogram checks the sample count and sum of a single histogram
+func assertHistogram(t *testing.T, observer prometheus.Observer, count uint64, sum float64) {
+	t.Helper()
+
+	metric := &dto.Metric{}
+	require.NoError(t, observer.(prometheus.Metric).Write(metric))
+	assert.Equal(t, count, metric.GetHistogram().GetSampleCount())
+	assert.InDelta(t, sum, metric.GetHistogram().GetSampleSum(), 0.001)
+}
+
+func TestWorkflowRunsTotalCounter(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry)
+
+	startTime := time.Now().Add(-60 * time.Second)
+	endTime := time.Now()
+
+	run := WorkflowRun{
+		ID:         4001,
+		Name:       "counter-test",
+		Repository: "myorg/myrepo",
+		Status:     WorkflowRunStatusCompleted,
+		Conclusion: WorkflowRunConclusionFailure,
+		RunAttempt: 1,
+		StartedAt:  startTime,
+		UpdatedAt:  endTime,
+		Branch:     "main",
+		Trigger:    "push",
+		RefType:    "branch",
+	}
+
+	// Repeated deliveries of the same completion should be counted once
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+
+	failures := processor.workflowRunsTotal.WithLabelValues("myorg/myrepo", "counter-test", "default", "same_repo", "failure")
+	assert.Equal(t, 1.0, testutil.ToFloat64(failures))
+
+	// A re-run is a new attempt and should be counted again
+	run.RunAttempt = 2
+	run.Conclusion = WorkflowRunConclusionSuccess
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+
+	successes := processor.workflowRunsTotal.WithLabelValues("myorg/myrepo", "counter-test", "default", "same_repo", "success")
+	assert.Equal(t, 1.0, testutil.ToFloat64(successes))
+	assert.Equal(t, 1.0, testutil.ToFloat64(failures))
+
+	duration, err := processor.workflowRunDuration.GetMetricWithLabelValues("myorg/myrepo", "counter-test", "default", "same_repo", "failure")
+	require.NoError(t, err)
+	assertHistogram(t, duration, 1, endTime.Sub(startTime).Seconds())
+}
+
+func TestWorkflowRunAttempts(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry)
+
+	startTime := time.Now().Add(-60 * time.Second)
+	endTime := time.Now()
+
+	run := WorkflowRun{
+		ID:         5001,
+		Name:       "attempt-test",
+		Repository: "myorg/myrepo",
+		Status:     WorkflowRunStatusCompleted,
+		Conclusion: WorkflowRunConclusionFailure,
+		RunAttempt: 1,
+		StartedAt:  startTime,
+		UpdatedAt:  endTime,
+		Branch:     "main",
+		Trigger:    "push",
+		RefType:    "branch",
+	}
+
+	// First attempt fails
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+
+	attempt, err := processor.workflowRunAttempt.GetMetricWithLabelValues("myorg/myrepo", "attempt-test", "main", "push", "branch")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(attempt))
+	assert.Equal(t, 0, testutil.CollectAndCount(processor.workflowRunReruns))
+
+	// Second attempt is started and succeeds
+	run.RunAttempt = 2
+	run.Status = WorkflowRunStatusInProgress
+	run.Conclusion = ""
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+	run.Status = WorkflowRunStatusCompleted
+	run.Conclusion = WorkflowRunConclusionSuccess
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(attempt))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.workflowRunReruns.WithLabelValues("myorg/myrepo", "attempt-test", "default", "same_repo")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.workflowRunsFlaky.WithLabelValues("myorg/myrepo", "attempt-test", "default", "same_repo")))
+
+	// A re-run of a successful run is not flaky
+	run.ID = 5002
+	run.RunAttempt = 2
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.workflowRunsFlaky.WithLabelValues("myorg/myrepo", "attempt-test", "default", "same_repo")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.workflowRunReruns.WithLabelValues("myorg/myrepo", "attempt-test", "default", "same_repo")))
+}
+
+func TestWorkflowRunRerunRedelivery(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	processor.now = func() time.Time { return now }
+
+	run := WorkflowRun{
+		ID:         5101,
+		Name:       "rerun-test",
+		Repository: "myorg/myrepo",
+		Status:     WorkflowRunStatusCompleted,
+		Conclusion: WorkflowRunConclusionSuccess,
+		RunAttempt: 2,
+		StartedAt:  now.Add(-time.Minute),
+		UpdatedAt:  now,
+		Branch:     "main",
+		Trigger:    "push",
+		RefType:    "branch",
+	}
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+
+	// A late delivery after the phases of the attempt were pruned is not another re-run
+	now = now.Add(25 * time.Hour)
+	processor.prune(now)
+	require.NotContains(t, processor.runPhases, runKey{id: 5101, attempt: 2})
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.workflowRunReruns.WithLabelValues("myorg/myrepo", "rerun-test", "default", "same_repo")))
+
+	// A new attempt is
+	run.RunAttempt = 3
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), run))
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.workflowRunReruns.WithLabelValues("myorg/myrepo", "rerun-test", "default", "same_repo")))
+}
+
+func TestWorkflowSeriesTTL(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithSeriesTTL(time.Hour, map[BranchClass]time.Duration{
+		BranchClassDefault: 0,
+	}))
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	processor.now = func() time.Time { return now }
+
+	for _, branch := range []string{"main", "feature/old"} {
+		err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+			ID:         6001,
+			Name:       "ttl-test",
+			Repository: "myorg/myrepo",
+			Status:     WorkflowRunStatusCompleted,
+			Conclusion: WorkflowRunConclusionSuccess,
+			RunAttempt: 1,
+			StartedAt:  now.Add(-time.Minute),
+			UpdatedAt:  now,
+			Branch:     branch,
+			Trigger:    "push",
+			RefType:    "branch",
+		})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, testutil.CollectAndCount(processor.workflowStatus))
+
+	// Within the TTL nothing is evicted
+	now = now.Add(30 * time.Minute)
+	processor.prune(now)
+	assert.Equal(t, 2, testutil.CollectAndCount(processor.workflowStatus))
+
+	// After the TTL the feature branch is evicted, the default branch is kept forever
+	now = now.Add(time.Hour)
+	processor.prune(now)
+	assert.Equal(t, 1, testutil.CollectAndCount(processor.workflowStatus))
+	assert.Equal(t, 1, testutil.CollectAndCount(processor.workflowRunAttempt))
+	_, err := processor.workflowStatus.GetMetricWithLabelValues("myorg/myrepo", "ttl-test", "main", "push", "branch")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.evictedSeries.WithLabelValues("feature")))
+}
+
+func TestWorkflowSeriesLimits(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithSeriesLimits(3, 2))
+
+	process := func(repository, branch string) {
+		err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+			ID:         7001,
+			Name:       "limit-test",
+			Repository: repository,
+			Status:     WorkflowRunStatusInProgress,
+			Branch:     branch,
+			Trigger:    "pull_request",
+			RefType:    "branch",
+		})
+		require.NoError(t, err)
+	}
+
+	process("myorg/monorepo", "main")
+	// Per repository limit reached, the last slot holds the overflow series of the repository
+	process("myorg/monorepo", "feature/a")
+	process("myorg/monorepo", "feature/b")
+	process("myorg/monorepo", "feature/c")
+	// Existing series are still updated
+	process("myorg/monorepo", "main")
+
+	_, err := processor.workflowStatus.GetMetricWithLabelValues("myorg/monorepo", OverflowBranch, OverflowBranch, OverflowBranch, OverflowBranch)
+	require.NoError(t, err)
+	assert.Equal(t, 2, testutil.CollectAndCount(processor.workflowStatus))
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.seriesCount.WithLabelValues("myorg/monorepo")))
+	assert.Equal(t, 3.0, testutil.ToFloat64(processor.overflowEvents.WithLabelValues("myorg/monorepo")))
+
+	// Overall limit reached, the last slot holds the overflow series of all other repositories
+	process("myorg/other", "main")
+	process("myorg/third", "main")
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.overflowEvents.WithLabelValues("myorg/other")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.overflowEvents.WithLabelValues("myorg/third")))
+	_, err = processor.workflowStatus.GetMetricWithLabelValues(OverflowBranch, OverflowBranch, OverflowBranch, OverflowBranch, OverflowBranch)
+	require.NoError(t, err)
+	assert.Equal(t, 3, testutil.CollectAndCount(processor.workflowStatus))
+}
+
+func TestWorkflowRunRelabeling(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithRelabelConfigs([]RelabelConfig{
+		// Fold feature and renovate branches into a single value
+		{SourceLabels: []string{"branch"}, Regex: "(feature|renovate)/.*", TargetLabel: "branch", Replacement: stringPtr("feature")},
+		// Drop the branch for pull request runs
+		{SourceLabels: []string{"trigger"}, Regex: "pull_request", TargetLabel: "branch", Replacement: stringPtr("")},
+		// Normalise workflow names
+		{SourceLabels: []string{"workflow"}, Regex: "(?i)ci( .*)?", TargetLabel: "workflow", Replacement: stringPtr("ci")},
+		// Ignore sandbox repositories
+		{SourceLabels: []string{"repository"}, Regex: "myorg/sandbox-.*", Action: RelabelActionDrop},
+	}))
+
+	process := func(repository, workflow, branch, trigger string) {
+		err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+			ID:         8001,
+			Name:       workflow,
+			Repository: repository,
+			Status:     WorkflowRunStatusInProgress,
+			Branch:     branch,
+			Trigger:    trigger,
+			RefType:    "branch",
+		})
+		require.NoError(t, err)
+	}
+
+	process("myorg/myrepo", "CI Build", "feature/login", "push")
+	process("myorg/myrepo", "CI", "renovate/gin-1.x", "push")
+	process("myorg/myrepo", "CI", "feature/login", "pull_request")
+	process("myorg/sandbox-test", "CI", "main", "push")
+
+	expected := `
+# HELP github_workflow_status Current status of workflow runs (0=timed_out, 1=failure, 2=startup_failure, 3=cancelled, 4=skipped, 5=neutral, 6=stale, 7=null, 8=action_required, 9=in_progress, 10=success)
+# TYPE github_workflow_status gauge
+github_workflow_status{branch="",ref_type="branch",repository="myorg/myrepo",trigger="pull_request",workflow="ci"} 9
+github_workflow_status{branch="feature",ref_type="branch",repository="myorg/myrepo",trigger="push",workflow="ci"} 9
+`
+	assert.NoError(t, testutil.CollectAndCompare(processor.workflowStatus, strings.NewReader(expected)))
+}
+
+func TestRelabelConfigValidation(t *testing.T) {
+	_, err := compileRelabelConfigs([]RelabelConfig{{SourceLabels: []string{"unknown"}, TargetLabel: "branch"}})
+	assert.Error(t, err)
+
+	_, err = compileRelabelConfigs([]RelabelConfig{{SourceLabels: []string{"branch"}, TargetLabel: "branch", Regex: "("}})
+	assert.Error(t, err)
+
+	_, err = compileRelabelConfigs([]RelabelConfig{{SourceLabels: []string{"branch"}, Action: "hashmod"}})
+	assert.Error(t, err)
+
+	_, err = compileRelabelConfigs([]RelabelConfig{{SourceLabels: []string{"branch"}, Action: RelabelActionKeep, Regex: "main"}})
+	assert.NoError(t, err)
+
+	// The processor rejects invalid rules instead of running without them
+	assert.Panics(t, func() {
+		NewMetricsProcessor(zaptest.NewLogger(t), prometheus.NewRegistry(), WithRelabelConfigs([]RelabelConfig{{SourceLabels: []string{"unknown"}, TargetLabel: "branch"}}))
+	})
+}
+
+func TestWorkflowRunFilters(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithFilters(FiltersConfig{
+		Owners:       FilterConfig{Allow: []string{"myorg"}},
+		Repositories: FilterConfig{Deny: []string{"myorg/archive-*"}},
+		Workflows:    FilterConfig{Deny: []string{"CodeQL", "/^Dependabot/"}},
+		Events:       FilterConfig{Allow: []string{"push", "pull_request"}},
+	}))
+
+	process := func(repository, workflow, trigger string) {
+		err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+			ID:         9001,
+			Name:       workflow,
+			Repository: repository,
+			Status:     WorkflowRunStatusInProgress,
+			Branch:     "main",
+			Trigger:    trigger,
+			RefType:    "branch",
+		})
+		require.NoError(t, err)
+	}
+
+	process("myorg/myrepo", "CI", "push")
+	process("otherorg/myrepo", "CI", "push")
+	process("myorg/archive-old", "CI", "push")
+	process("myorg/myrepo", "CodeQL", "push")
+	process("myorg/myrepo", "Dependabot Updates", "dynamic")
+	process("myorg/myrepo", "CI", "schedule")
+
+	assert.Equal(t, 1, testutil.CollectAndCount(processor.workflowStatus))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.droppedEvents.WithLabelValues("owner_not_allowed")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.droppedEvents.WithLabelValues("repository_denied")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.droppedEvents.WithLabelValues("workflow_denied")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.droppedEvents.WithLabelValues("event_not_allowed")))
+}
+
+func TestFilterConfigValidation(t *testing.T) {
+	_, err := compileFilters(FiltersConfig{Workflows: FilterConfig{Deny: []string{"/(/"}}})
+	assert.Error(t, err)
+
+	_, err = compileFilters(FiltersConfig{Repositories: FilterConfig{Allow: []string{"myorg/["}}})
+	assert.Error(t, err)
+}
+
+func TestWorkflowRunOutOfOrderEvents(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry)
+
+	startTime := time.Now().Add(-10 * time.Minute)
+	endTime := time.Now()
+
+	newRun := func(id int64, status WorkflowRunStatus, conclusion WorkflowRunConclusion, updatedAt time.Time) WorkflowRun {
+		return WorkflowRun{
+			ID:         id,
+			Name:       "order-test",
+			Repository: "myorg/myrepo",
+			Status:     status,
+			Conclusion: conclusion,
+			RunAttempt: 1,
+			StartedAt:  startTime,
+			UpdatedAt:  updatedAt,
+			Branch:     "main",
+			Trigger:    "push",
+			RefType:    "branch",
+		}
+	}
+
+	gauge, err := processor.workflowStatus.GetMetricWithLabelValues("myorg/myrepo", "order-test", "main", "push", "branch")
+	require.NoError(t, err)
+
+	// The completion arrives before the in_progress delivery of the same run
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), newRun(100, WorkflowRunStatusCompleted, WorkflowRunConclusionSuccess, endTime)))
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), newRun(100, WorkflowRunStatusInProgress, "", startTime)))
+	assert.Equal(t, 10.0, testutil.ToFloat64(gauge))
+
+	// Same update time, but in_progress is earlier in the lifecycle than completed
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), newRun(100, WorkflowRunStatusInProgress, "", endTime)))
+	assert.Equal(t, 10.0, testutil.ToFloat64(gauge))
+
+	// A newer run fails, then a late delivery of an older run arrives
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), newRun(101, WorkflowRunStatusCompleted, WorkflowRunConclusionFailure, endTime)))
+	require.NoError(t, processor.ProcessWorkflowRun(context.Background(), newRun(99, WorkflowRunStatusCompleted, WorkflowRunConclusionSuccess, endTime)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(gauge))
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(processor.staleEvents.WithLabelValues("myorg/myrepo")))
+
+	// Completions of older runs are still counted
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.workflowRunsTotal.WithLabelValues("myorg/myrepo", "order-test", "default", "same_repo", "success")))
+}
+
+func TestWorkflowTimestampGauges(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry)
+
+	base := time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+
+	process := func(id int64, status WorkflowRunStatus, conclusion WorkflowRunConclusion, updatedAt time.Time) {
+		err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+			ID:         id,
+			Name:       "nightly",
+			Repository: "myorg/myrepo",
+			Status:     status,
+			Conclusion: conclusion,
+			RunAttempt: 1,
+			StartedAt:  updatedAt.Add(-time.Minute),
+			UpdatedAt:  updatedAt,
+			Branch:     "main",
+			Trigger:    "schedule",
+			RefType:    "branch",
+		})
+		require.NoError(t, err)
+	}
+
+	labels := []string{"myorg/myrepo", "nightly", "main", "schedule", "branch"}
+
+	process(1, WorkflowRunStatusCompleted, WorkflowRunConclusionSuccess, base)
+	process(2, WorkflowRunStatusCompleted, WorkflowRunConclusionFailure, base.Add(24*time.Hour))
+	process(3, WorkflowRunStatusInProgress, "", base.Add(48*time.Hour))
+
+	assert.Equal(t, float64(base.Add(48*time.Hour).Unix()), testutil.ToFloat64(processor.workflowLastRun.WithLabelValues(labels...)))
+	assert.Equal(t, float64(base.Unix()), testutil.ToFloat64(processor.workflowLastSuccess.WithLabelValues(labels...)))
+	assert.Equal(t, float64(base.Add(24*time.Hour).Unix()), testutil.ToFloat64(processor.workflowLastFailure.WithLabelValues(labels...)))
+
+	// Timestamps never move backwards
+	process(1, WorkflowRunStatusCompleted, WorkflowRunConclusionSuccess, base)
+	assert.Equal(t, float64(base.Add(48*time.Hour).Unix()), testutil.ToFloat64(processor.workflowLastRun.WithLabelValues(labels...)))
+}
+
+func TestWorkflowRunInfo(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithRunInfoLimit(2))
+
+	process := func(id int64, status WorkflowRunStatus) {
+		err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+			ID:         id,
+			RunNumber:  int(id - 1000),
+			Name:       "info-test",
+			Repository: "myorg/myrepo",
+			Status:     status,
+			RunAttempt: 1,
+			Branch:     "main",
+			Trigger:    "push",
+			RefType:    "branch",
+			HeadSHA:    "abc123",
+			Actor:      "octocat",
+			HTMLURL:    "https://github.com/myorg/myrepo/actions/runs/" + strconv.FormatInt(id, 10),
+		})
+		require.NoError(t, err)
+	}
+
+	process(1001, WorkflowRunStatusInProgress)
+	process(1001, WorkflowRunStatusCompleted)
+	process(1003, WorkflowRunStatusCompleted)
+	process(1002, WorkflowRunStatusCompleted)
+	// The oldest run is garbage collected once the limit is exceeded
+	process(1004, WorkflowRunStatusInProgress)
+	// Late deliveries of runs older than the retained ones are not exposed
+	process(1001, WorkflowRunStatusCompleted)
+
+	expected := `
+# HELP github_workflow_run_info Metadata of the latest workflow runs, always 1
+# TYPE github_workflow_run_info gauge
+github_workflow_run_info{actor="octocat",branch="main",head_sha="abc123",html_url="https://github.com/myorg/myrepo/actions/runs/1003",ref_type="branch",repository="myorg/myrepo",run_id="1003",run_number="3",trigger="push",workflow="info-test"} 1
+github_workflow_run_info{actor="octocat",branch="main",head_sha="abc123",html_url="https://github.com/myorg/myrepo/actions/runs/1004",ref_type="branch",repository="myorg/myrepo",run_id="1004",run_number="4",trigger="push",workflow="info-test"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(processor.workflowRunInfo, strings.NewReader(expected)))
+}
+
+func TestWorkflowIdentity(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithWorkflowLabel(WorkflowLabelID))
+
+	process := func(id int64, name string) {
+		err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+			ID:           id,
+			Name:         name,
+			WorkflowID:   161335,
+			WorkflowPath: ".github/workflows/ci.yml",
+			Repository:   "myorg/myrepo",
+			Status:       WorkflowRunStatusInProgress,
+			Branch:       "main",
+			Trigger:      "push",
+			RefType:      "branch",
+		})
+		require.NoError(t, err)
+	}
+
+	process(1, "CI")
+	// The workflow is renamed, its series keep the same identity
+	process(2, "Build and test")
+	// A late delivery from before the rename does not revert the name
+	process(1, "CI")
+
+	_, err := processor.workflowStatus.GetMetricWithLabelValues("myorg/myrepo", "161335", "main", "push", "branch")
+	require.NoError(t, err)
+	assert.Equal(t, 1, testutil.CollectAndCount(processor.workflowStatus))
+
+	expected := `
+# HELP github_workflow_info Current name and path of workflows, by workflow ID, always 1
+# TYPE github_workflow_info gauge
+github_workflow_info{repository="myorg/myrepo",workflow="161335",workflow_id="161335",workflow_name="Build and test",workflow_path=".github/workflows/ci.yml"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(processor.workflowInfo, strings.NewReader(expected)))
+}
+
+func TestWorkflowInfoLimitsAndExpiry(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry,
+		WithWorkflowLabel(WorkflowLabelID),
+		WithSeriesTTL(time.Hour, nil),
+		WithSeriesLimits(0, 2))
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	processor.now = func() time.Time { return now }
+
+	for _, workflowID := range []int64{101, 102} {
+		err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+			ID:           workflowID,
+			Name:         "CI",
+			WorkflowID:   workflowID,
+			WorkflowPath: ".github/workflows/ci.yml",
+			Repository:   "myorg/myrepo",
+			Status:       WorkflowRunStatusInProgress,
+			Branch:       "feature/info",
+			Trigger:      "push",
+			RefType:      "branch",
+		})
+		require.NoError(t, err)
+	}
+
+	// The second workflow is folded into the overflow series and gets no info series
+	assert.Equal(t, 2, testutil.CollectAndCount(processor.workflowStatus))
+	assert.Equal(t, 1, testutil.CollectAndCount(processor.workflowInfo))
+
+	// The info series expires with the series of the workflow
+	now = now.Add(2 * time.Hour)
+	processor.prune(now)
+	assert.Equal(t, 0, testutil.CollectAndCount(processor.workflowStatus))
+	assert.Equal(t, 0, testutil.CollectAndCount(processor.workflowInfo))
+	assert.Empty(t, processor.workflows)
+	assert.Equal(t, 3.0, testutil.ToFloat64(processor.evictedSeries.WithLabelValues("feature")))
+}
+
+func TestWorkflowRunsActiveGauges(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithRunTimeout(time.Hour))
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	processor.now = func() time.Time { return now }
+
+	process := func(id int64, status WorkflowRunStatus) {
+		err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+			ID:         id,
+			Name:       "active-test",
+			Repository: "myorg/myrepo",
+			Status:     status,
+			RunAttempt: 1,
+			UpdatedAt:  now,
+			Branch:     "main",
+			Trigger:    "push",
+			RefType:    "branch",
+		})
+		require.NoError(t, err)
+	}
+
+	queued := processor.workflowRunsQueued.WithLabelValues("myorg/myrepo", "active-test")
+	inProgress := processor.workflowRunsInProgress.WithLabelValues("myorg/myrepo", "active-test")
+
+	process(1, WorkflowRunStatusQueued)
+	process(2, WorkflowRunStatusQueued)
+	process(3, WorkflowRunStatusQueued)
+	assert.Equal(t, 3.0, testutil.ToFloat64(queued))
+
+	process(1, WorkflowRunStatusInProgress)
+	process(2, WorkflowRunStatusInProgress)
+	process(2, WorkflowRunStatusInProgress)
+	assert.Equal(t, 1.0, testutil.ToFloat64(queued))
+	assert.Equal(t, 2.0, testutil.ToFloat64(inProgress))
+
+	// Completions, including a late in_progress delivery, leave the gauges consistent
+	process(1, WorkflowRunStatusCompleted)
+	process(1, WorkflowRunStatusInProgress)
+	process(3, WorkflowRunStatusCompleted)
+	assert.Equal(t, 0.0, testutil.ToFloat64(queued))
+	assert.Equal(t, 1.0, testutil.ToFloat64(inProgress))
+
+	// Runs that never complete are reaped after the timeout
+	now = now.Add(2 * time.Hour)
+	processor.prune(now)
+	assert.Equal(t, 0.0, testutil.ToFloat64(inProgress))
+	assert.Equal(t, 1.0, testutil.ToFloat64(processor.reapedRuns.WithLabelValues("myorg/myrepo")))
+}
+
+func TestPullRequestRunsCounter(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithRelabelConfigs([]RelabelConfig{
+		// Report pull request runs by their base branch instead of their head branch
+		{SourceLabels: []string{"trigger", "base_branch"}, Regex: "pull_request;(.+)", TargetLabel: "branch"},
+	}))
+
+	process := func(id int64, trigger, branch, baseBranch string, conclusion WorkflowRunConclusion) {
+		err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+			ID:         id,
+			Name:       "pr-test",
+			Repository: "myorg/myrepo",
+			Status:     WorkflowRunStatusCompleted,
+			Conclusion: conclusion,
+			RunAttempt: 1,
+			Branch:     branch,
+			BaseBranch: baseBranch,
+			Trigger:    trigger,
+			RefType:    "branch",
+		})
+		require.NoError(t, err)
+	}
+
+	process(1, "pull_request", "feature/a", "main", WorkflowRunConclusionSuccess)
+	process(2, "pull_request", "feature/b", "main", WorkflowRunConclusionFailure)
+	process(3, "pull_request", "fix/c", "release/1.0", WorkflowRunConclusionSuccess)
+	process(4, "push", "main", "", WorkflowRunConclusionSuccess)
+
+	expected := `
+# HELP github_workflow_pull_request_runs_total Total number of completed workflow runs triggered by pull requests, by base branch
+# TYPE github_workflow_pull_request_runs_total counter
+github_workflow_pull_request_runs_total{base_branch="main",conclusion="failure",origin="same_repo",repository="myorg/myrepo",workflow="pr-test"} 1
+github_workflow_pull_request_runs_total{base_branch="main",conclusion="success",origin="same_repo",repository="myorg/myrepo",workflow="pr-test"} 1
+github_workflow_pull_request_runs_total{base_branch="release/1.0",conclusion="success",origin="same_repo",repository="myorg/myrepo",workflow="pr-test"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(processor.pullRequestRuns, strings.NewReader(expected)))
+
+	// Head branches do not end up in the label space
+	_, err := processor.workflowStatus.GetMetricWithLabelValues("myorg/myrepo", "pr-test", "release/1.0", "pull_request", "branch")
+	require.NoError(t, err)
+	assert.Equal(t, 3, testutil.CollectAndCount(processor.workflowStatus))
+}
+
+func TestRunOrigin(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	registry := prometheus.NewRegistry()
+	processor := NewMetricsProcessor(logger, registry, WithRelabelConfigs([]RelabelConfig{
+		// Renaming the repository must not turn same repository runs into forks
+		{SourceLabels: []string{"repository"}, Regex: "myorg/(.*)", TargetLabel: "repository"},
+	}))
+
+	process := func(id int64, headRepository string, conclusion WorkflowRunConclusion) {
+		err := processor.ProcessWorkflowRun(context.Background(), WorkflowRun{
+			ID:             id,
+			Name:           "origin-test",
+			Repository:     "myorg/myrepo",
+			HeadRepository: headRepository,
+			Status:         WorkflowRunStatusCompleted,
+			Conclusion:     conclusion,
+			RunAttempt:     1,
+			Branch:         "feature/a",
+			BaseBranch:     "main",
+			Trigger:        "pull_request",
+			RefType:        "branch",
+		})
+		require.NoError(t, err)
+	}
+
+	process(1, "myorg/myrepo", WorkflowRunConclusionSuccess)
+	process(2, "contributor/myrepo", WorkflowRunConclusionFailure)
+	process(3, "other/myrepo", WorkflowRunConclusionFailure)
+	process(4, "", WorkflowRunConclusionSuccess)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.workflowRunsTotal.WithLabelValues("myrepo", "origin-test", "feature", "same_repo", "success")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.workflowRunsTotal.WithLabelValues("myrepo", "origin-test", "feature", "fork", "failure")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(processor.pullRequestRuns.WithLabelValues("myrepo", "origin-test", "main", "fork", "failure")))
+	assert.Equal(t, 2, testutil.CollectAndCount(processor.workflowRunsTotal))
+}
@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RelabelAction is the action a relabel rule performs
+type RelabelAction string
+
+// Constants for relabel actions
+const (
+	RelabelActionReplace RelabelAction = "replace"
+	RelabelActionKeep    RelabelAction = "keep"
+	RelabelActionDrop    RelabelAction = "drop"
+)
+
+// Constants for the label names relabel rules can read and write
+const (
+	LabelRepository = "repository"
+	LabelWorkflow   = "workflow"
+	LabelBranch     = "branch"
+	LabelTrigger    = "trigger"
+	LabelRefType    = "ref_type"
+	LabelBaseBranch = "base_branch"
+)
+
+// RelabelConfig is a relabel rule applied to workflow runs before metrics are updated,
+// modelled after Prometheus relabel_configs
+type RelabelConfig struct {
+	// SourceLabels are joined with Separator and matched against Regex
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+	// Regex is anchored on both ends
+	Regex string `yaml:"regex"`
+	// TargetLabel receives Replacement, with capture groups expanded, for the replace action.
+	// Replacement defaults to "$1" when unset; an empty replacement clears the target label.
+	TargetLabel string        `yaml:"target_label"`
+	Replacement *string       `yaml:"replacement"`
+	Action      RelabelAction `yaml:"action"`
+}
+
+// relabelRule is a compiled RelabelConfig
+type relabelRule struct {
+	RelabelConfig
+	replacement string
+	regex       *regexp.Regexp
+}
+
+// compileRelabelConfigs validates and compiles relabel rules
+func compileRelabelConfigs(configs []RelabelConfig) ([]relabelRule, error) {
+	rules := make([]relabelRule, 0, len(configs))
+	for i, cfg := range configs {
+		if cfg.Action == "" {
+			cfg.Action = RelabelActionReplace
+		}
+		if cfg.Separator == "" {
+			cfg.Separator = ";"
+		}
+		if cfg.Regex == "" {
+			cfg.Regex = "(.*)"
+		}
+		replacement := "$1"
+		if cfg.Replacement != nil {
+			replacement = *cfg.Replacement
+		}
+
+		if len(cfg.SourceLabels) == 0 {
+			return nil, fmt.Errorf("relabel rule %d: source_labels is required", i)
+		}
+		for _, label := range cfg.SourceLabels {
+			if !isRelabelLabel(label) {
+				return nil, fmt.Errorf("relabel rule %d: unknown source label %q", i, label)
+			}
+		}
+
+		switch cfg.Action {
+		case RelabelActionReplace:
+			if !isRelabelLabel(cfg.TargetLabel) {
+				return nil, fmt.Errorf("relabel rule %d: unknown target label %q", i, cfg.TargetLabel)
+			}
+		case RelabelActionKeep, RelabelActionDrop:
+		default:
+			return nil, fmt.Errorf("relabel rule %d: unknown action %q", i, cfg.Action)
+		}
+
+		regex, err := regexp.Compile("^(?:" + cfg.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: invalid regex: %w", i, err)
+		}
+
+		rules = append(rules, relabelRule{RelabelConfig: cfg, replacement: replacement, regex: regex})
+	}
+
+	return rules, nil
+}
+
+// isRelabelLabel reports whether relabel rules can use the label name
+func isRelabelLabel(name string) bool {
+	switch name {
+	case LabelRepository, LabelWorkflow, LabelBranch, LabelTrigger, LabelRefType, LabelBaseBranch:
+		return true
+	}
+	return false
+}
+
+// relabel applies the rules in order and returns the rewritten run, or false if the run is dropped
+func relabel(rules []relabelRule, run WorkflowRun) (WorkflowRun, bool) {
+	// Classify the branch and origin before rules rewrite them
+	run.branchClass = run.BranchClass()
+	run.origin = run.Origin()
+
+	for _, rule := range rules {
+		values := make([]string, len(rule.SourceLabels))
+		for i, label := range rule.SourceLabels {
+			values[i] = *runLabel(&run, label)
+		}
+		value := strings.Join(values, rule.Separator)
+
+		switch rule.Action {
+		case RelabelActionKeep:
+			if !rule.regex.MatchString(value) {
+				return run, false
+			}
+		case RelabelActionDrop:
+			if rule.regex.MatchString(value) {
+				return run, false
+			}
+		case RelabelActionReplace:
+			match := rule.regex.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			target := rule.regex.ExpandString(nil, rule.replacement, value, match)
+			*runLabel(&run, rule.TargetLabel) = string(target)
+		}
+	}
+
+	return run, true
+}
+
+// runLabel returns a pointer to the field of the run that backs the label
+func runLabel(run *WorkflowRun, name string) *string {
+	switch name {
+	case LabelRepository:
+		return &run.Repository
+	case LabelWorkflow:
+		return &run.Name
+	case LabelBranch:
+		return &run.Branch
+	case LabelTrigger:
+		return &run.Trigger
+	case LabelRefType:
+		return &run.RefType
+	case LabelBaseBranch:
+		return &run.BaseBranch
+	}
+	panic("unknown relabel label " + name)
+}
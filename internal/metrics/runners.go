@@ -0,0 +1,186 @@
+package metrics
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// runnerLabels normalises the runner labels requested by a job into a stable label value:
+// labels are lower cased, deduplicated, sorted and joined with commas
+func runnerLabels(labels []string) string {
+	normalised := make([]string, 0, len(labels))
+	for _, label := range labels {
+		label = strings.ToLower(strings.TrimSpace(label))
+		if label != "" {
+			normalised = append(normalised, label)
+		}
+	}
+	slices.Sort(normalised)
+	return strings.Join(slices.Compact(normalised), ",")
+}
+
+// RunnerType tells whether a job ran on a GitHub hosted or a self-hosted runner
+type RunnerType string
+
+// Constants for runner types
+const (
+	RunnerTypeGitHubHosted RunnerType = "github_hosted"
+	RunnerTypeSelfHosted   RunnerType = "self_hosted"
+)
+
+// selfHostedLabel is the label carried by every self-hosted runner
+const selfHostedLabel = "self-hosted"
+
+// GitHubHostedRunnerGroup is the runner group of the standard GitHub hosted runners
+const GitHubHostedRunnerGroup = "GitHub Actions"
+
+// RunnerType classifies the runner of the job. Jobs requesting the self-hosted label run on
+// self-hosted runners. Otherwise the runner group tells, as jobs on runner scale sets or targeted
+// by a custom label do not request it; only while no runner is known the job is assumed to run on
+// a GitHub hosted runner.
+func (j WorkflowJob) RunnerType() RunnerType {
+	for _, label := range j.Labels {
+		if strings.EqualFold(strings.TrimSpace(label), selfHostedLabel) {
+			return RunnerTypeSelfHosted
+		}
+	}
+	if j.RunnerGroupName != "" && j.RunnerGroupName != GitHubHostedRunnerGroup {
+		return RunnerTypeSelfHosted
+	}
+	return RunnerTypeGitHubHosted
+}
+
+// runnerType classifies the runner of the job like WorkflowJob.RunnerType, except that jobs
+// requesting a larger runner SKU of the price table run on GitHub hosted runners, whatever their
+// runner group. Must be called with p.mu held.
+func (p *MetricsProcessor) runnerType(job WorkflowJob) RunnerType {
+	runnerType := job.RunnerType()
+	if runnerType == RunnerTypeSelfHosted && !slices.ContainsFunc(job.Labels, func(label string) bool {
+		return strings.EqualFold(strings.TrimSpace(label), selfHostedLabel)
+	}) {
+		if _, _, ok := p.cfg.Billing.skuPrice(job.Labels); ok {
+			return RunnerTypeGitHubHosted
+		}
+	}
+	return runnerType
+}
+
+// runnerKey identifies a runner within its runner group
+type runnerKey struct {
+	group string
+	name  string
+}
+
+// busyRunner is a runner that is currently executing a job
+type busyRunner struct {
+	jobID      int64
+	runnerType RunnerType
+	lastSeen   time.Time // Wall clock time of the last event for the job
+}
+
+// runnerState records what is needed to expire the per-runner counters of a self-hosted runner
+type runnerState struct {
+	lastUpdate time.Time
+}
+
+// trackRunner updates the runner metrics with the job. completed tells whether this event is the
+// first completion of the job. Must be called with p.mu held.
+func (p *MetricsProcessor) trackRunner(job WorkflowJob, state *jobState, completed bool) {
+	if job.RunnerName == "" {
+		return
+	}
+
+	key := runnerKey{group: job.RunnerGroupName, name: job.RunnerName}
+	runnerType := p.runnerType(job)
+
+	switch {
+	case job.Status == WorkflowRunStatusInProgress && !state.completed:
+		p.setRunnerBusy(key, job.ID, runnerType)
+	case completed:
+		if runner, ok := p.busyRunners[key]; ok && runner.jobID == job.ID {
+			p.setRunnerIdle(key)
+		}
+		p.accountRunnerJob(key, job, runnerType)
+	}
+}
+
+// setRunnerBusy marks the runner as executing the job. A runner that picked up another job
+// while the completion of its previous job was lost stays counted once. Must be called with p.mu held.
+func (p *MetricsProcessor) setRunnerBusy(key runnerKey, jobID int64, runnerType RunnerType) {
+	runner, ok := p.busyRunners[key]
+	if !ok {
+		runner = &busyRunner{}
+		p.busyRunners[key] = runner
+		p.runnersBusy.WithLabelValues(key.group, string(runnerType)).Inc()
+	} else if runner.runnerType != runnerType {
+		p.runnersBusy.WithLabelValues(key.group, string(runner.runnerType)).Dec()
+		p.runnersBusy.WithLabelValues(key.group, string(runnerType)).Inc()
+	}
+
+	runner.jobID = jobID
+	runner.runnerType = runnerType
+	runner.lastSeen = p.now()
+}
+
+// setRunnerIdle marks the runner as no longer executing a job. Must be called with p.mu held.
+func (p *MetricsProcessor) setRunnerIdle(key runnerKey) {
+	runner, ok := p.busyRunners[key]
+	if !ok {
+		return
+	}
+	p.runnersBusy.WithLabelValues(key.group, string(runner.runnerType)).Dec()
+	delete(p.busyRunners, key)
+}
+
+// accountRunnerJob counts the completed job and its busy time for the runner group and, for
+// self-hosted runners, for the runner itself. GitHub hosted runners are single use, so they
+// are only accounted by group. Must be called with p.mu held.
+func (p *MetricsProcessor) accountRunnerJob(key runnerKey, job WorkflowJob, runnerType RunnerType) {
+	busy := 0.0
+	if !job.StartedAt.IsZero() && !job.CompletedAt.Before(job.StartedAt) {
+		busy = job.CompletedAt.Sub(job.StartedAt).Seconds()
+	}
+
+	p.runnerGroupJobs.WithLabelValues(key.group, string(runnerType)).Inc()
+	p.runnerGroupBusySeconds.WithLabelValues(key.group, string(runnerType)).Add(busy)
+
+	if runnerType != RunnerTypeSelfHosted {
+		return
+	}
+
+	p.runnerJobs.WithLabelValues(key.group, key.name).Inc()
+	p.runnerBusySeconds.WithLabelValues(key.group, key.name).Add(busy)
+
+	state, ok := p.runners[key]
+	if !ok {
+		state = &runnerState{}
+		p.runners[key] = state
+	}
+	state.lastUpdate = p.now()
+}
+
+// pruneRunners releases busy runners whose job did not receive an event within the run timeout,
+// and expires the per-runner counters of runners that did not run a job within the runner TTL,
+// such as ephemeral runners. Runners are not tied to a branch, so they have a TTL of their own.
+// Must be called with p.mu held.
+func (p *MetricsProcessor) pruneRunners(now time.Time) {
+	if p.cfg.RunTimeout > 0 {
+		for key, runner := range p.busyRunners {
+			if now.Sub(runner.lastSeen) > p.cfg.RunTimeout {
+				p.setRunnerIdle(key)
+			}
+		}
+	}
+
+	if p.cfg.RunnerTTL <= 0 {
+		return
+	}
+	for key, state := range p.runners {
+		if now.Sub(state.lastUpdate) > p.cfg.RunnerTTL {
+			p.runnerJobs.DeleteLabelValues(key.group, key.name)
+			p.runnerBusySeconds.DeleteLabelValues(key.group, key.name)
+			delete(p.runners, key)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package metrics
+
+import (
+	"slices"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// OverflowBranch is the label value that new label sets are folded into once a cardinality limit is reached
+const OverflowBranch = "__overflow__"
+
+// overflowSeriesKey returns the label set that new label sets of the repository are folded into.
+// The overall overflow label set uses OverflowBranch as the repository.
+func overflowSeriesKey(repository string) seriesKey {
+	return seriesKey{
+		repository: repository,
+		workflow:   OverflowBranch,
+		branch:     OverflowBranch,
+		trigger:    OverflowBranch,
+		refType:    OverflowBranch,
+	}
+}
+
+// seriesKey identifies the label set of the per-branch workflow gauges
+type seriesKey struct {
+	repository string
+	workflow   string
+	branch     string
+	trigger    string
+	refType    string
+}
+
+// labels returns the label values in the order used by the per-branch workflow gauges
+func (k seriesKey) labels() []string {
+	return []string{k.repository, k.workflow, k.branch, k.trigger, k.refType}
+}
+
+// classUpdates records the last update of a series by the runs of each branch class, for series
+// that runs of several branch classes update
+type classUpdates map[BranchClass]time.Time
+
+// expired reports whether no run updated the series within the TTL of its branch class, and
+// returns the branch class of the latest update
+func (u classUpdates) expired(cfg Config, now time.Time) (BranchClass, bool) {
+	var latest BranchClass
+	for class, lastUpdate := range u {
+		if ttl := cfg.seriesTTL(class); ttl <= 0 || now.Sub(lastUpdate) <= ttl {
+			return "", false
+		}
+		if latest == "" || lastUpdate.After(u[latest]) {
+			latest = class
+		}
+	}
+	return latest, true
+}
+
+// seriesState records what is needed to expire a label set and to order its updates
+type seriesState struct {
+	class      BranchClass
+	lastUpdate time.Time
+
+	// Latest run reported by the series
+	runID      int64
+	runAttempt int
+	updatedAt  time.Time
+	status     WorkflowRunStatus
+
+	// Most recent update times reported by any run of the series
+	lastRunAt     time.Time
+	lastSuccessAt time.Time
+	lastFailureAt time.Time
+
+	// Run info series of the latest runs, ordered by run ID
+	runInfos []runInfo
+}
+
+// runInfo is an exposed run info series
+type runInfo struct {
+	runID  int64
+	labels []string
+}
+
+// isOlder reports whether the run is older than the latest run reported by the series. GitHub
+// does not guarantee delivery order, so runs are ordered by run ID, attempt, update time and
+// finally by lifecycle status.
+func (s *seriesState) isOlder(run WorkflowRun) bool {
+	if run.ID != s.runID {
+		return run.ID < s.runID
+	}
+	if run.RunAttempt != s.runAttempt {
+		return run.RunAttempt < s.runAttempt
+	}
+	if !run.UpdatedAt.Equal(s.updatedAt) {
+		return run.UpdatedAt.Before(s.updatedAt)
+	}
+	return statusRank(run.Status) < statusRank(s.status)
+}
+
+// statusRank orders workflow run statuses by their position in the lifecycle
+func statusRank(status WorkflowRunStatus) int {
+	switch status {
+	case WorkflowRunStatusCompleted:
+		return 2
+	case WorkflowRunStatusInProgress:
+		return 1
+	}
+	return 0
+}
+
+// touchSeries records an update of the label set of a run and returns its key. It reports
+// false when the run is older than the latest run of the series, in which case the series
+// must not be updated. Must be called with p.mu held.
+func (p *MetricsProcessor) touchSeries(run WorkflowRun) (seriesKey, bool) {
+	key := seriesKey{
+		repository: run.Repository,
+		workflow:   run.Name,
+		branch:     run.Branch,
+		trigger:    run.Trigger,
+		refType:    run.RefType,
+	}
+
+	state, ok := p.series[key]
+	if !ok {
+		if limited := p.limitSeries(key); limited != key {
+			p.overflowEvents.WithLabelValues(key.repository).Inc()
+			key = limited
+			state, ok = p.series[key]
+		}
+		if !ok {
+			state = &seriesState{class: run.BranchClass()}
+			p.series[key] = state
+			p.seriesPerRepository[key.repository]++
+			p.seriesCount.WithLabelValues(key.repository).Set(float64(p.seriesPerRepository[key.repository]))
+		}
+	}
+	if state.isOlder(run) {
+		return key, false
+	}
+
+	state.lastUpdate = p.now()
+	state.runID = run.ID
+	state.runAttempt = run.RunAttempt
+	state.updatedAt = run.UpdatedAt
+	state.status = run.Status
+
+	return key, true
+}
+
+// limitSeries returns the label set a new label set is reported with. Once the repository
+// reaches its limit, new label sets are folded into the overflow label set of the repository;
+// once the overall limit is reached, into the overall overflow label set. Each limit keeps a
+// slot for its overflow label set, so that the limits are hard bounds. Must be called with p.mu held.
+func (p *MetricsProcessor) limitSeries(key seriesKey) seriesKey {
+	if limit := p.cfg.MaxSeriesPerRepository; limit > 0 && !p.seriesFit(p.seriesPerRepository[key.repository], limit, overflowSeriesKey(key.repository)) {
+		key = overflowSeriesKey(key.repository)
+	}
+	if _, ok := p.series[key]; ok {
+		return key
+	}
+	if limit := p.cfg.MaxSeries; limit > 0 && !p.seriesFit(len(p.series), limit, overflowSeriesKey(OverflowBranch)) {
+		key = overflowSeriesKey(OverflowBranch)
+	}
+	return key
+}
+
+// seriesFit reports whether a new label set fits within the limit besides the given overflow
+// label set, which is reserved a slot until it exists. Must be called with p.mu held.
+func (p *MetricsProcessor) seriesFit(count, limit int, overflow seriesKey) bool {
+	if _, ok := p.series[overflow]; !ok {
+		count++
+	}
+	return count < limit
+}
+
+// updateTimestamps moves the last run, success and failure timestamps of the series forward.
+// Late deliveries are taken into account, as they may still be the most recent success or failure.
+// Must be called with p.mu held.
+func (p *MetricsProcessor) updateTimestamps(key seriesKey, run WorkflowRun) {
+	state, ok := p.series[key]
+	if !ok || run.UpdatedAt.IsZero() {
+		return
+	}
+
+	labels := key.labels()
+	if run.UpdatedAt.After(state.lastRunAt) {
+		state.lastRunAt = run.UpdatedAt
+		p.workflowLastRun.WithLabelValues(labels...).Set(float64(run.UpdatedAt.Unix()))
+	}
+
+	if run.Status != WorkflowRunStatusCompleted {
+		return
+	}
+
+	if run.Conclusion == WorkflowRunConclusionSuccess && run.UpdatedAt.After(state.lastSuccessAt) {
+		state.lastSuccessAt = run.UpdatedAt
+		p.workflowLastSuccess.WithLabelValues(labels...).Set(float64(run.UpdatedAt.Unix()))
+	}
+	if isFailedConclusion(run.Conclusion) && run.UpdatedAt.After(state.lastFailureAt) {
+		state.lastFailureAt = run.UpdatedAt
+		p.workflowLastFailure.WithLabelValues(labels...).Set(float64(run.UpdatedAt.Unix()))
+	}
+}
+
+// updateRunInfo exposes the metadata of the run and garbage collects the info series of older runs,
+// keeping the latest RunInfoLimit runs per series. Must be called with p.mu held.
+func (p *MetricsProcessor) updateRunInfo(key seriesKey, run WorkflowRun) {
+	state, ok := p.series[key]
+	if !ok || p.cfg.RunInfoLimit <= 0 {
+		return
+	}
+
+	position := len(state.runInfos)
+	for i, info := range state.runInfos {
+		if info.runID == run.ID {
+			return
+		}
+		if run.ID < info.runID {
+			position = i
+			break
+		}
+	}
+
+	// A late delivery of a run older than all retained runs is not exposed
+	if position == 0 && len(state.runInfos) >= p.cfg.RunInfoLimit {
+		return
+	}
+
+	labels := append(key.labels(), strconv.FormatInt(run.ID, 10), strconv.Itoa(run.RunNumber), run.HeadSHA, run.Actor, run.HTMLURL)
+	p.workflowRunInfo.WithLabelValues(labels...).Set(1)
+	state.runInfos = slices.Insert(state.runInfos, position, runInfo{runID: run.ID, labels: labels})
+
+	for len(state.runInfos) > p.cfg.RunInfoLimit {
+		p.workflowRunInfo.DeleteLabelValues(state.runInfos[0].labels...)
+		state.runInfos = state.runInfos[1:]
+	}
+}
+
+// expireSeries deletes the label sets that have not been updated within the TTL of their branch class.
+// Must be called with p.mu held.
+func (p *MetricsProcessor) expireSeries(now time.Time) {
+	for key, state := range p.series {
+		ttl := p.cfg.seriesTTL(state.class)
+		if ttl <= 0 || now.Sub(state.lastUpdate) <= ttl {
+			continue
+		}
+
+		p.deleteSeries(key)
+		p.evictedSeries.WithLabelValues(string(state.class)).Inc()
+		p.logger.Debug("Evicted stale workflow series",
+			zap.String("repository", key.repository),
+			zap.String("workflow", key.workflow),
+			zap.String("branch", key.branch))
+	}
+}
+
+// deleteSeries removes a label set from all per-branch workflow gauges.
+// Must be called with p.mu held.
+func (p *MetricsProcessor) deleteSeries(key seriesKey) {
+	labels := key.labels()
+	p.workflowStatus.DeleteLabelValues(labels...)
+	p.workflowRunAttempt.DeleteLabelValues(labels...)
+	p.workflowLastRun.DeleteLabelValues(labels...)
+	p.workflowLastSuccess.DeleteLabelValues(labels...)
+	p.workflowLastFailure.DeleteLabelValues(labels...)
+	for _, info := range p.series[key].runInfos {
+		p.workflowRunInfo.DeleteLabelValues(info.labels...)
+	}
+	delete(p.series, key)
+
+	p.seriesPerRepository[key.repository]--
+	if p.seriesPerRepository[key.repository] <= 0 {
+		delete(p.seriesPerRepository, key.repository)
+		p.seriesCount.DeleteLabelValues(key.repository)
+	} else {
+		p.seriesCount.WithLabelValues(key.repository).Set(float64(p.seriesPerRepository[key.repository]))
+	}
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OverflowStep is the step label value that new step names are folded into once the per-job limit is reached
+const OverflowStep = "__overflow__"
+
+// WorkflowStep represents a step of a workflow job
+type WorkflowStep struct {
+	Name        string
+	Number      int
+	Status      WorkflowRunStatus
+	Conclusion  WorkflowRunConclusion
+	StartedAt   time.Time
+	CompletedAt time.Time
+}
+
+// observeSteps records the duration and failures of the steps of a completed job, across its
+// matrix combinations, with the exemplar of the job. Step names beyond MaxStepsPerJob are folded
+// into the overflow step. Must be called with p.mu held.
+func (p *MetricsProcessor) observeSteps(key jobSeriesKey, job WorkflowJob, exemplar prometheus.Labels) {
+	state, ok := p.jobNames[key.nameKey()]
+	if !ok {
+		return
+	}
+
+	for _, step := range job.Steps {
+		if step.Status != WorkflowRunStatusCompleted || step.Conclusion == WorkflowRunConclusionSkipped {
+			continue
+		}
+
+		name := p.stepLabel(state, step.Name)
+		if isFailedConclusion(step.Conclusion) {
+			incWithExemplar(p.workflowStepFailures.WithLabelValues(key.repository, key.workflow, key.job, name), exemplar)
+		}
+		if !step.StartedAt.IsZero() && !step.CompletedAt.Before(step.StartedAt) {
+			observeWithExemplar(p.workflowStepDuration.WithLabelValues(key.repository, key.workflow, key.job, name), step.CompletedAt.Sub(step.StartedAt).Seconds(), exemplar)
+		}
+	}
+}
+
+// stepLabel returns the value of the step label, or the overflow step once the job has reached
+// its limit of step names. The limit keeps a slot for the overflow step, so that it is a hard
+// bound. Must be called with p.mu held.
+func (p *MetricsProcessor) stepLabel(state *jobNameState, name string) string {
+	if state.steps[name] {
+		return name
+	}
+	if p.cfg.MaxStepsPerJob > 0 && len(state.steps)+1 >= p.cfg.MaxStepsPerJob {
+		return OverflowStep
+	}
+
+	if state.steps == nil {
+		state.steps = make(map[string]bool)
+	}
+	state.steps[name] = true
+	return name
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Constants for the values that can be used for the workflow label
+const (
+	WorkflowLabelName = "name"
+	WorkflowLabelID   = "id"
+	WorkflowLabelPath = "path"
+)
+
+// workflowKey identifies a workflow independently of its display name
+type workflowKey struct {
+	repository string
+	workflowID int64
+}
+
+// workflowInfoState is the exposed info series of a workflow
+type workflowInfoState struct {
+	runID  int64 // Run that last updated the info, to ignore late deliveries
+	labels []string
+
+	// Last update by runs of each branch class, the info expires with the series of the workflow
+	lastUpdate classUpdates
+}
+
+// validateWorkflowLabel checks the workflow label setting
+func validateWorkflowLabel(value string) error {
+	switch value {
+	case "", WorkflowLabelName, WorkflowLabelID, WorkflowLabelPath:
+		return nil
+	}
+	return fmt.Errorf("unknown workflow label %q, expected %q, %q or %q", value, WorkflowLabelName, WorkflowLabelID, WorkflowLabelPath)
+}
+
+// workflowLabel returns the value used for the workflow label of the run. Runs without a
+// workflow ID or path fall back to the display name.
+func (p *MetricsProcessor) workflowLabel(run WorkflowRun) string {
+	switch p.cfg.WorkflowLabel {
+	case WorkflowLabelID:
+		if run.WorkflowID != 0 {
+			return strconv.FormatInt(run.WorkflowID, 10)
+		}
+	case WorkflowLabelPath:
+		if run.WorkflowPath != "" {
+			return run.WorkflowPath
+		}
+	}
+	return run.Name
+}
+
+// updateWorkflowInfo maps the workflow ID to its current name and path, replacing the info
+// series when the workflow was renamed or moved. Runs reported with an overflow label set do not
+// create an info series, so that the info series stay within the cardinality limits.
+// Must be called with p.mu held.
+func (p *MetricsProcessor) updateWorkflowInfo(series seriesKey, run WorkflowRun, name string) {
+	if run.WorkflowID == 0 || series == overflowSeriesKey(series.repository) {
+		return
+	}
+
+	key := workflowKey{repository: run.Repository, workflowID: run.WorkflowID}
+	labels := []string{run.Repository, run.Name, strconv.FormatInt(run.WorkflowID, 10), run.WorkflowPath, name}
+
+	info, ok := p.workflows[key]
+	if ok {
+		if run.ID < info.runID {
+			return
+		}
+		if !slices.Equal(info.labels, labels) {
+			p.workflowInfo.DeleteLabelValues(info.labels...)
+		}
+	} else {
+		info = &workflowInfoState{lastUpdate: make(classUpdates)}
+		p.workflows[key] = info
+	}
+
+	info.lastUpdate[run.BranchClass()] = p.now()
+	info.runID = run.ID
+	info.labels = labels
+	p.workflowInfo.WithLabelValues(labels...).Set(1)
+}
+
+// pruneWorkflows deletes the info series of workflows that no run updated within the TTL of its
+// branch class, like the series of their runs. Must be called with p.mu held.
+func (p *MetricsProcessor) pruneWorkflows(now time.Time) {
+	for key, info := range p.workflows {
+		class, expired := info.lastUpdate.expired(p.cfg, now)
+		if !expired {
+			continue
+		}
+
+		p.workflowInfo.DeleteLabelValues(info.labels...)
+		delete(p.workflows, key)
+		p.evictedSeries.WithLabelValues(string(class)).Inc()
+		p.logger.Debug("Evicted stale workflow info",
+			zap.String("repository", key.repository),
+			zap.Int64("workflowID", key.workflowID))
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"gh-actions-exporter/internal/config"
 	"gh-actions-exporter/internal/handlers"
 	"gh-actions-exporter/internal/metrics"
 	"github.com/gin-gonic/gin"
@@ -52,10 +53,18 @@ func StartServer(port string, webhookSecret string) {
 
 	logger.Info("Logger initialized", zap.String("level", logLevel))
 
+	cfg, err := config.Load()
+	if err != nil {
+		logger.Fatal("Failed to load configuration", zap.Error(err))
+	}
+
 	registry := prometheus.NewRegistry()
-	processor := metrics.NewMetricsProcessor(logger, registry)
+	processor := metrics.NewMetricsProcessor(logger, registry, metrics.WithConfig(cfg.Metrics))
 	exposer := metrics.NewMetricsExposer(logger, registry)
 
+	// Expire stale series in the background
+	go processor.Run(ctx)
+
 	r := gin.New()
 	r.Use(
 		gin.LoggerWithWriter(gin.DefaultWriter, "/health"),
@@ -68,9 +77,17 @@ func StartServer(port string, webhookSecret string) {
 		handlers.WebhookHandler(c, processor, logger, webhookSecret)
 	})
 
+	// Serve the queued job backlog to runner autoscalers
+	r.GET("/api/v1/backlog", func(c *gin.Context) {
+		handlers.BacklogHandler(c, processor)
+	})
+
 	r.GET("/health", handleHealth)
 
 	exposer.WithMetricsEndpoint(r)
+	if cfg.ExternalMetricsAPI {
+		exposer.WithExternalMetricsAPI(r, processor)
+	}
 
 	// Start HTTP server
 	server := &http.Server{